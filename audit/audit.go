@@ -0,0 +1,278 @@
+// Package audit keeps an append-only record of what teachers did: who
+// connected to which class, takeovers, every command sent to a student along
+// with how it ended, class-wide broadcasts and kicks. Entries are JSON lines in a local file, each
+// carrying the hash of the one before it, so editing, reordering or deleting
+// an entry breaks the chain from that point on (see Verify and
+// cmd/auditverify). Cutting entries off the end leaves a valid chain, so
+// note the head hash somewhere else now and then; the server logs it at
+// startup.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"saber-websocket/utils"
+	"sync"
+	"time"
+)
+
+// Events recorded
+const (
+	EventTeacherConnected    = "teacher_connected"
+	EventTeacherDisconnected = "teacher_disconnected"
+	EventTeacherTakeover     = "teacher_takeover" // Detail: the takeover policy's outcome
+	EventTeacherPromoted     = "teacher_promoted" // Demoted owner got the class back
+	EventCommand             = "command"          // Data: the command's arguments
+	EventCommandResult       = "command_result"   // Detail: the final state and reason; Data: the result
+	EventCommandDenied       = "command_denied"   // Detail: the policy's reason
+	EventBroadcast           = "broadcast"        // StudentID: AllStudents; Detail: how many received it
+	EventKick                = "kick"             // Detail: the outcome and the teacher's reason
+)
+
+// Events lists every event the log records
+var Events = []string{
+	EventTeacherConnected, EventTeacherDisconnected, EventTeacherTakeover, EventTeacherPromoted,
+	EventCommand, EventCommandResult, EventCommandDenied, EventBroadcast, EventKick,
+}
+
+// AllStudents is the StudentID of entries addressed to a whole class
+const AllStudents = "*"
+
+// Entry is one line of the log
+type Entry struct {
+	Seq       uint64          `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Instance  string          `json:"instance,omitempty"`
+	Event     string          `json:"event"`
+	ClassCode string          `json:"classCode"`
+	TeacherID string          `json:"teacherId,omitempty"`
+	Role      string          `json:"role,omitempty"`
+	StudentID string          `json:"studentId,omitempty"`
+	Command   string          `json:"command,omitempty"`
+	CommandID string          `json:"commandId,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+	RemoteIP  string          `json:"remoteIp,omitempty"`
+	// Hash of the previous entry ("" for the first), and of this one
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// computeHash covers the previous hash and every field but Hash itself
+func (e Entry) computeHash() string {
+	e.Hash = ""
+	body, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.Prev+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Log appends entries to the audit file. A nil *Log records nothing.
+type Log struct {
+	path     string
+	instance string
+	logger   *utils.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+	head string // Hash of the last entry
+}
+
+// Open continues the chain in path, creating the file if needed. It doesn't
+// check the existing entries; run Verify for that.
+func Open(path, instance string, logger *utils.Logger) (*Log, error) {
+	l := &Log{path: path, instance: instance, logger: logger}
+	if f, err := os.Open(path); err == nil {
+		last, err := lastEntry(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if last != nil {
+			l.seq, l.head = last.Seq, last.Hash
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// lastEntry returns the final readable entry of a log, or nil for an empty
+// one. Damage further up is Verify's business; the chain carries on from here.
+func lastEntry(r io.Reader) (*Entry, error) {
+	var last *Entry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLine)
+	for sc.Scan() {
+		var e Entry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Hash != "" {
+			last = &e
+		}
+	}
+	return last, sc.Err()
+}
+
+// Head returns the sequence number and hash of the newest entry
+func (l *Log) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Record numbers, chains and appends an entry. Write failures are logged
+// rather than returned: a full disk shouldn't stop a class.
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.Instance = l.instance
+	e.Prev = l.head
+	e.Hash = e.computeHash()
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		l.logger.Error(fmt.Sprintf("Audit log write failed (%s %s): %v", e.Event, e.ClassCode, err))
+		return
+	}
+	l.seq, l.head = e.Seq, e.Hash
+}
+
+// Close flushes the file to disk
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Sync()
+	return l.file.Close()
+}
+
+// Filter selects entries for Query; zero fields match everything. A
+// StudentID filter also matches the class-wide entries (broadcasts) of the
+// class named by ClassCode, since they reached that student too.
+type Filter struct {
+	TeacherID string
+	StudentID string
+	ClassCode string
+	Event     string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // Keep only the newest Limit matches
+}
+
+func (f *Filter) match(e *Entry) bool {
+	return (f.TeacherID == "" || e.TeacherID == f.TeacherID) &&
+		(f.StudentID == "" || e.StudentID == f.StudentID || (e.StudentID == AllStudents && f.ClassCode != "")) &&
+		(f.ClassCode == "" || e.ClassCode == f.ClassCode) &&
+		(f.Event == "" || e.Event == f.Event) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query reads the log back, oldest first. truncated reports whether older
+// matches were left out to honour the limit.
+func (l *Log) Query(f Filter) (entries []*Entry, truncated bool, err error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	err = Read(file, func(line int, e *Entry) error {
+		if !f.match(e) {
+			return nil
+		}
+		entries = append(entries, e)
+		if f.Limit > 0 && len(entries) > f.Limit {
+			entries, truncated = entries[1:], true
+		}
+		return nil
+	})
+	return entries, truncated, err
+}
+
+// ChainError is where verification found the log had been tampered with
+type ChainError struct {
+	Line   int
+	Seq    uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("line %d (seq %d): %s", e.Line, e.Seq, e.Reason)
+}
+
+// Verify walks a log checking that sequence numbers run on without gaps and
+// every hash matches its entry and its predecessor. It returns the number of
+// entries and the newest one; a broken chain is a *ChainError.
+func Verify(r io.Reader) (int, *Entry, error) {
+	var prev *Entry
+	count := 0
+	err := Read(r, func(line int, e *Entry) error {
+		fail := func(format string, args ...interface{}) error {
+			return &ChainError{Line: line, Seq: e.Seq, Reason: fmt.Sprintf(format, args...)}
+		}
+		wantSeq, wantPrev := uint64(1), ""
+		if prev != nil {
+			wantSeq, wantPrev = prev.Seq+1, prev.Hash
+		}
+		if e.Seq != wantSeq {
+			return fail("expected seq %d", wantSeq)
+		}
+		if e.Prev != wantPrev {
+			return fail("does not follow the previous entry")
+		}
+		if e.Hash != e.computeHash() {
+			return fail("contents do not match the hash")
+		}
+		prev = e
+		count++
+		return nil
+	})
+	return count, prev, err
+}
+
+// Longest entry read back; commands are far smaller than this
+const maxLine = 16 * 1024 * 1024
+
+// Read calls fn for every entry of a log, stopping at fn's first error.
+// Unparseable lines are a *ChainError.
+func Read(r io.Reader, fn func(line int, e *Entry) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLine)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return &ChainError{Line: line, Reason: "not an entry: " + err.Error()}
+		}
+		if err := fn(line, &e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"saber-websocket/utils"
+	"strings"
+	"testing"
+)
+
+// testLog records n entries and returns the file's lines
+func testLog(t *testing.T, n int) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, "test", utils.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		l.Record(Entry{Event: EventCommand, ClassCode: "C1", TeacherID: "t1", StudentID: "s1", Command: "lock_screen"})
+	}
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// edit rewrites one entry, optionally fixing up its own hash afterwards
+func edit(t *testing.T, line string, rehash bool, change func(e *Entry)) string {
+	t.Helper()
+	var e Entry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+	change(&e)
+	if rehash {
+		e.Hash = e.computeHash()
+	}
+	out, _ := json.Marshal(e)
+	return string(out)
+}
+
+func TestVerify(t *testing.T) {
+	lines := testLog(t, 4)
+	join := func(lines ...string) string { return strings.Join(lines, "\n") + "\n" }
+
+	cases := []struct {
+		name     string
+		log      string
+		count    int
+		failLine int // 0 when the chain should verify
+	}{
+		{"intact", join(lines...), 4, 0},
+		{"empty", "", 0, 0},
+		{"blank lines", join(lines[0], "", lines[1], lines[2], lines[3]), 4, 0},
+		// Cut off at the end: still a valid chain, which is what -head is for
+		{"truncated", join(lines[:2]...), 2, 0},
+
+		{"edited entry", join(lines[0], edit(t, lines[1], false, func(e *Entry) { e.Command = "open_tab" }), lines[2], lines[3]), 1, 2},
+		{"edited entry, rehashed", join(lines[0], edit(t, lines[1], true, func(e *Entry) { e.Command = "open_tab" }), lines[2], lines[3]), 2, 3},
+		{"edited hash", join(lines[0], lines[1], edit(t, lines[2], false, func(e *Entry) { e.Hash = strings.Repeat("0", 64) }), lines[3]), 2, 3},
+		{"deleted entry", join(lines[0], lines[2], lines[3]), 1, 2},
+		{"deleted first entry", join(lines[1:]...), 0, 1},
+		{"deleted entry, renumbered", join(lines[0], edit(t, lines[2], true, func(e *Entry) { e.Seq = 2 }), lines[3]), 1, 2},
+		{"reordered", join(lines[0], lines[2], lines[1], lines[3]), 1, 2},
+		{"duplicated", join(lines[0], lines[1], lines[1], lines[2], lines[3]), 2, 3},
+		{"garbage line", join(lines[0], "{not json", lines[1]), 1, 2},
+	}
+	for _, c := range cases {
+		count, last, err := Verify(strings.NewReader(c.log))
+		if count != c.count {
+			t.Errorf("%s: %d good entries, want %d", c.name, count, c.count)
+		}
+		if c.failLine == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if c.count > 0 && (last == nil || last.Seq != uint64(c.count)) {
+				t.Errorf("%s: last entry %+v, want seq %d", c.name, last, c.count)
+			}
+			continue
+		}
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) {
+			t.Errorf("%s: err = %v, want a *ChainError", c.name, err)
+		} else if chainErr.Line != c.failLine {
+			t.Errorf("%s: failed at line %d (%v), want line %d", c.name, chainErr.Line, err, c.failLine)
+		}
+	}
+}
+
+// Reopening a log carries the chain on from its last entry
+func TestOpenContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path, "test", utils.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Record(Entry{Event: EventTeacherConnected, ClassCode: "C1", TeacherID: "t1"})
+		l.Record(Entry{Event: EventTeacherDisconnected, ClassCode: "C1", TeacherID: "t1"})
+		l.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, last, err := Verify(bytes.NewReader(data))
+	if err != nil || count != 4 {
+		t.Fatalf("Verify = %d, %v; want 4 entries", count, err)
+	}
+	l, err := Open(path, "test", utils.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq, head := l.Head(); seq != last.Seq || head != last.Hash {
+		t.Errorf("Head = %d %s, want %d %s", seq, head, last.Seq, last.Hash)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.log"), "test", utils.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Record(Entry{Event: EventCommand, ClassCode: "C1", TeacherID: "t1", StudentID: "s1", Command: "lock_screen"})
+	l.Record(Entry{Event: EventBroadcast, ClassCode: "C1", TeacherID: "t1", StudentID: AllStudents, Command: "open_tab"})
+	l.Record(Entry{Event: EventKick, ClassCode: "C1", TeacherID: "t2", StudentID: "s2", Detail: "kicked"})
+	l.Record(Entry{Event: EventBroadcast, ClassCode: "C2", TeacherID: "t3", StudentID: AllStudents, Command: "lock_screen"})
+	l.Record(Entry{Event: EventKick, ClassCode: "C2", TeacherID: "t3", StudentID: "s1", Detail: "forwarded"})
+
+	cases := []struct {
+		name   string
+		filter Filter
+		want   []uint64 // Seqs of the matching entries
+	}{
+		{"everything", Filter{}, []uint64{1, 2, 3, 4, 5}},
+		{"broadcasts", Filter{Event: EventBroadcast}, []uint64{2, 4}},
+		{"kicks", Filter{Event: EventKick}, []uint64{3, 5}},
+		{"kicks in a class", Filter{Event: EventKick, ClassCode: "C2"}, []uint64{5}},
+		{"kicks by a teacher", Filter{Event: EventKick, TeacherID: "t2"}, []uint64{3}},
+		{"kicked student", Filter{Event: EventKick, StudentID: "s2"}, []uint64{3}},
+
+		// A student's history takes in the broadcasts of the class asked about
+		{"student in a class", Filter{StudentID: "s1", ClassCode: "C1"}, []uint64{1, 2}},
+		{"student in another class", Filter{StudentID: "s1", ClassCode: "C2"}, []uint64{4, 5}},
+		{"student without a class", Filter{StudentID: "s1"}, []uint64{1, 5}},
+		{"broadcasts to a student", Filter{StudentID: "s2", ClassCode: "C1", Event: EventBroadcast}, []uint64{2}},
+
+		{"limit", Filter{Event: EventBroadcast, Limit: 1}, []uint64{4}},
+	}
+	for _, c := range cases {
+		entries, _, err := l.Query(c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var got []uint64
+		for _, e := range entries {
+			got = append(got, e.Seq)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got seqs %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got seqs %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
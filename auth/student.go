@@ -0,0 +1,30 @@
+package auth
+
+import "errors"
+
+// ErrBindingMismatch is returned when an enrollment token was issued for a
+// different clientId, email or class than the one being claimed
+var ErrBindingMismatch = errors.New("enrollment token does not match this student")
+
+// EnrollmentClaims binds a student's extension identity to a single class
+type EnrollmentClaims struct {
+	ClientID  string `json:"sub"`
+	Email     string `json:"email"`
+	ClassCode string `json:"class"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// VerifyEnrollment validates an enrollment token against the identity the
+// student presented in student_connect
+func VerifyEnrollment(secret []byte, token, clientID, email, classCode string) (*EnrollmentClaims, error) {
+	var claims EnrollmentClaims
+	if err := Verify(secret, token, &claims); err != nil {
+		return nil, err
+	}
+	if claims.ClientID == "" || claims.ClientID != clientID ||
+		claims.Email != email || claims.ClassCode != classCode {
+		return nil, ErrBindingMismatch
+	}
+	return &claims, nil
+}
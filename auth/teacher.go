@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"saber-websocket/models"
+)
+
+// ErrClassNotAllowed is returned when a valid token does not cover the requested class
+var ErrClassNotAllowed = errors.New("token does not grant access to this class")
+
+// TeacherClaims identifies a teacher and the classes they may control
+type TeacherClaims struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Classes []string `json:"classes"`
+	// Staff role: owner (default), co_teacher or observer. Roles overrides it per class.
+	Role      string            `json:"role,omitempty"`
+	Roles     map[string]string `json:"roles,omitempty"`
+	IssuedAt  int64             `json:"iat,omitempty"`
+	ExpiresAt int64             `json:"exp"`
+}
+
+// CanControl reports whether the claims grant access to a class.
+// A "*" entry grants every class (district admins).
+func (c *TeacherClaims) CanControl(classCode string) bool {
+	for _, allowed := range c.Classes {
+		if allowed == "*" || allowed == classCode {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleFor returns the staff role the token grants in a class
+func (c *TeacherClaims) RoleFor(classCode string) string {
+	if role, ok := c.Roles[classCode]; ok {
+		return role
+	}
+	if c.Role == "" {
+		return models.RoleOwner
+	}
+	return c.Role
+}
+
+// VerifyTeacher validates a teacher token for a specific class
+func VerifyTeacher(secret []byte, token, classCode string) (*TeacherClaims, error) {
+	var claims TeacherClaims
+	if err := Verify(secret, token, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, ErrMalformed
+	}
+	if !claims.CanControl(classCode) {
+		return nil, ErrClassNotAllowed
+	}
+	if !models.ValidRole(claims.RoleFor(classCode)) {
+		return nil, ErrMalformed
+	}
+	return &claims, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test-secret")
+
+// forge builds a token from raw header and claims JSON, signed with secret
+// (unsigned when secret is nil)
+func forge(secret []byte, header, claims string) string {
+	input := b64.EncodeToString([]byte(header)) + "." + b64.EncodeToString([]byte(claims))
+	if secret == nil {
+		return input + "."
+	}
+	return input + "." + b64.EncodeToString(sign(secret, input))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now().Unix()
+	valid := func(extra string) string {
+		return `{"sub":"t1","exp":` + strconv.FormatInt(now+60, 10) + extra + `}`
+	}
+	good := forge(testSecret, `{"alg":"HS256","typ":"JWT"}`, valid(""))
+	parts := strings.Split(good, ".")
+
+	cases := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", good, nil},
+		{"wrong alg", forge(testSecret, `{"alg":"HS512","typ":"JWT"}`, valid("")), ErrAlgorithm},
+		{"alg none", forge(nil, `{"alg":"none","typ":"JWT"}`, valid("")), ErrAlgorithm},
+		{"alg None", forge(nil, `{"alg":"None","typ":"JWT"}`, valid("")), ErrAlgorithm},
+		{"no alg", forge(testSecret, `{"typ":"JWT"}`, valid("")), ErrAlgorithm},
+		{"expired", forge(testSecret, `{"alg":"HS256"}`, `{"sub":"t1","exp":`+strconv.FormatInt(now-1, 10)+`}`), ErrExpired},
+		{"no exp", forge(testSecret, `{"alg":"HS256"}`, `{"sub":"t1"}`), ErrExpired},
+		{"not yet valid", forge(testSecret, `{"alg":"HS256"}`, valid(`,"nbf":`+strconv.FormatInt(now+30, 10))), ErrNotYet},
+		{"nbf passed", forge(testSecret, `{"alg":"HS256"}`, valid(`,"nbf":`+strconv.FormatInt(now-30, 10))), nil},
+		{"tampered payload", parts[0] + "." + b64.EncodeToString([]byte(valid(`,"admin":true`))) + "." + parts[2], ErrSignature},
+		{"tampered header", b64.EncodeToString([]byte(`{"alg":"HS256","typ":"x"}`)) + "." + parts[1] + "." + parts[2], ErrSignature},
+		{"wrong key", forge([]byte("other-secret"), `{"alg":"HS256"}`, valid("")), ErrSignature},
+		{"stripped signature", parts[0] + "." + parts[1] + ".", ErrSignature},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformed},
+		{"bad base64", parts[0] + "." + parts[1] + ".!!", ErrMalformed},
+		{"header not JSON", forge(testSecret, `HS256`, valid("")), ErrMalformed},
+		{"claims not JSON", forge(testSecret, `{"alg":"HS256"}`, `{"exp":`), ErrMalformed},
+	}
+	for _, c := range cases {
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err := Verify(testSecret, c.token, &claims); err != c.want {
+			t.Errorf("%s: Verify = %v, want %v", c.name, err, c.want)
+		} else if err == nil && claims.Subject != "t1" {
+			t.Errorf("%s: sub = %q, want t1", c.name, claims.Subject)
+		}
+	}
+
+	if err := Verify(nil, good, &struct{}{}); err != ErrNoSecret {
+		t.Errorf("no secret: Verify = %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	in := TeacherClaims{Subject: "t1", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	token, err := Sign(testSecret, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out TeacherClaims
+	if err := Verify(testSecret, token, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Subject != in.Subject || out.ExpiresAt != in.ExpiresAt {
+		t.Errorf("round trip: got %+v, want %+v", out, in)
+	}
+	if _, err := Sign(nil, in); err != ErrNoSecret {
+		t.Errorf("Sign without a secret = %v, want %v", err, ErrNoSecret)
+	}
+}
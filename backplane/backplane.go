@@ -0,0 +1,46 @@
+package backplane
+
+// A Backplane links several server instances so that a teacher connected to
+// one instance can see and command students connected to another. Each hub
+// publishes its own lifecycle events and any relayed messages whose audience
+// may live elsewhere; every other instance receives them.
+
+// Envelope kinds
+const (
+	KindStudentJoined = "student_joined" // A student registered on the origin instance
+	KindStudentLeft   = "student_left"   // A student's slot was released on the origin instance
+	KindStaffCount    = "staff_count"    // Number of staff dashboards the origin has for a class
+	KindSyncRequest   = "sync_request"   // Ask other instances to re-announce a class
+	KindRelay         = "relay"          // Deliver Payload to Target within ClassCode
+	KindStream        = "stream"         // Deliver a lossy Payload (screenshots) to staff of ClassCode
+	KindCommand       = "command"        // Deliver a teacher command (Payload) to student ClientID
+	KindCommandReply  = "command_reply"  // Delivery outcome or student reply for CommandID
+	KindKick          = "kick"           // Disconnect student ClientID; Payload is the reason
+	KindPeerDown      = "peer_down"      // Synthesized locally when a peer link is lost
+)
+
+// Envelope is a hub event or routed message exchanged between instances
+type Envelope struct {
+	Origin    string `json:"origin"` // Instance that published it
+	Kind      string `json:"kind"`
+	ClassCode string `json:"classCode,omitempty"`
+	Target    string `json:"target,omitempty"` // BroadcastMessage target for relays
+	ClientID  string `json:"clientId,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Count     int    `json:"count,omitempty"`
+	CommandID string `json:"commandId,omitempty"`
+
+	// Raw WebSocket message for relays; carried outside the JSON header
+	Payload []byte `json:"-"`
+}
+
+// Backplane publishes envelopes to every other instance
+type Backplane interface {
+	// Publish sends an envelope to all other instances. It must not block
+	// on slow peers; envelopes may be dropped under backpressure.
+	Publish(env *Envelope) error
+	// Subscribe registers the handler for envelopes from other instances.
+	// It must be called before the first Publish.
+	Subscribe(handler func(*Envelope))
+	Close() error
+}
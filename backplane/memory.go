@@ -0,0 +1,92 @@
+package backplane
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when a subscriber cannot keep up
+var ErrQueueFull = errors.New("backplane queue full")
+
+// Memory is an in-process bus connecting several hubs, useful for running
+// multiple hubs in one binary and for exercising the backplane without a network.
+type Memory struct {
+	mu      sync.RWMutex
+	members map[string]*memoryMember
+}
+
+func NewMemory() *Memory {
+	return &Memory{members: make(map[string]*memoryMember)}
+}
+
+// Join returns the Backplane handle for one instance on the bus
+func (m *Memory) Join(instanceID string) Backplane {
+	member := &memoryMember{
+		bus:   m,
+		id:    instanceID,
+		queue: make(chan *Envelope, 1024),
+		done:  make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.members[instanceID] = member
+	m.mu.Unlock()
+	return member
+}
+
+type memoryMember struct {
+	bus     *Memory
+	id      string
+	queue   chan *Envelope
+	handler func(*Envelope)
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (mm *memoryMember) Subscribe(handler func(*Envelope)) {
+	mm.handler = handler
+	go func() {
+		for {
+			select {
+			case env := <-mm.queue:
+				handler(env)
+			case <-mm.done:
+				return
+			}
+		}
+	}()
+}
+
+func (mm *memoryMember) Publish(env *Envelope) error {
+	env.Origin = mm.id
+	mm.bus.mu.RLock()
+	defer mm.bus.mu.RUnlock()
+
+	var err error
+	for id, other := range mm.bus.members {
+		if id == mm.id {
+			continue
+		}
+		select {
+		case other.queue <- env:
+		default:
+			err = ErrQueueFull
+		}
+	}
+	return err
+}
+
+func (mm *memoryMember) Close() error {
+	mm.once.Do(func() {
+		mm.bus.mu.Lock()
+		delete(mm.bus.members, mm.id)
+		for _, other := range mm.bus.members {
+			select {
+			case other.queue <- &Envelope{Origin: mm.id, Kind: KindPeerDown}:
+			default:
+			}
+		}
+		mm.bus.mu.Unlock()
+		close(mm.done)
+	})
+	return nil
+}
@@ -0,0 +1,386 @@
+package backplane
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"saber-websocket/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxHeaderSize  = 64 * 1024
+	maxPayloadSize = 64 * 1024 * 1024
+	linkQueueSize  = 1024
+
+	handshakeTimeout = 5 * time.Second
+	nonceSize        = 32
+)
+
+// Peer links instances directly over TCP or Unix sockets.
+//
+// Every instance listens on its own address and dials every other instance.
+// Envelopes are written only on dialed links and only read from accepted
+// ones, so a full mesh needs each instance to list all the others as peers.
+// Addresses are "host:port" for TCP or "unix:/path/to.sock".
+//
+// Links open with a challenge-response handshake over a shared secret (see
+// handshake below), and a link that fails it is dropped before any envelope
+// is read: envelopes go straight to the hub, past every token and policy
+// check. Without a secret the listener is confined to unix sockets and
+// loopback addresses.
+type Peer struct {
+	id     string
+	secret []byte
+	logger *utils.Logger
+
+	listener net.Listener
+	mu       sync.RWMutex
+	links    map[string]*peerLink // Outbound links by dial address
+	handler  func(*Envelope)
+
+	done chan struct{}
+	once sync.Once
+}
+
+// peerLink is a single outbound connection with its own write queue
+type peerLink struct {
+	queue chan *Envelope
+}
+
+// NewPeer starts listening on listenAddr and dialing every address in peers.
+// Every instance must share the same secret.
+func NewPeer(instanceID, listenAddr, secret string, peers []string, logger *utils.Logger) (*Peer, error) {
+	network, addr := splitAddr(listenAddr)
+	if secret == "" && !localOnly(network, addr) {
+		return nil, fmt.Errorf("backplane listen %s: a shared secret is required to listen beyond loopback", listenAddr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("backplane listen %s: %w", listenAddr, err)
+	}
+
+	p := &Peer{
+		id:       instanceID,
+		secret:   []byte(secret),
+		logger:   logger,
+		listener: listener,
+		links:    make(map[string]*peerLink),
+		done:     make(chan struct{}),
+	}
+	go p.acceptLoop()
+	for _, peerAddr := range peers {
+		if peerAddr = strings.TrimSpace(peerAddr); peerAddr != "" && peerAddr != listenAddr {
+			go p.dialLoop(peerAddr)
+		}
+	}
+	return p, nil
+}
+
+func (p *Peer) Subscribe(handler func(*Envelope)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handler = handler
+}
+
+func (p *Peer) Publish(env *Envelope) error {
+	env.Origin = p.id
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var err error
+	for _, link := range p.links {
+		select {
+		case link.queue <- env:
+		default:
+			err = ErrQueueFull
+		}
+	}
+	return err
+}
+
+func (p *Peer) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		p.listener.Close()
+	})
+	return nil
+}
+
+func (p *Peer) deliver(env *Envelope) {
+	p.mu.RLock()
+	handler := p.handler
+	p.mu.RUnlock()
+	if handler != nil {
+		handler(env)
+	}
+}
+
+// --- Inbound ---
+
+func (p *Peer) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			p.logger.Warn("Backplane accept failed: " + err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go p.readLink(conn)
+	}
+}
+
+func (p *Peer) readLink(conn net.Conn) {
+	defer conn.Close()
+	if err := p.acceptHandshake(conn); err != nil {
+		p.logger.Warn(fmt.Sprintf("Backplane link from %s refused: %v", conn.RemoteAddr(), err))
+		return
+	}
+	r := bufio.NewReader(conn)
+	origin := ""
+	for {
+		env, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Warn(fmt.Sprintf("Backplane link from %s closed: %v", conn.RemoteAddr(), err))
+			}
+			break
+		}
+		if origin == "" {
+			origin = env.Origin
+			p.logger.Info(fmt.Sprintf("Backplane peer %s connected", origin))
+		}
+		p.deliver(env)
+	}
+	if origin != "" {
+		p.logger.Warn(fmt.Sprintf("Backplane peer %s disconnected", origin))
+		p.deliver(&Envelope{Origin: origin, Kind: KindPeerDown})
+	}
+}
+
+// --- Outbound ---
+
+func (p *Peer) dialLoop(addr string) {
+	backoff := time.Second
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		network, target := splitAddr(addr)
+		conn, err := net.DialTimeout(network, target, 5*time.Second)
+		if err != nil {
+			time.Sleep(backoff)
+			if backoff < 10*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		if err := p.dialHandshake(conn); err != nil {
+			conn.Close()
+			p.logger.Warn(fmt.Sprintf("Backplane link to %s refused: %v", addr, err))
+			time.Sleep(backoff)
+			if backoff < 10*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		p.logger.Info("Backplane linked to " + addr)
+
+		link := &peerLink{queue: make(chan *Envelope, linkQueueSize)}
+		p.mu.Lock()
+		p.links[addr] = link
+		p.mu.Unlock()
+
+		// Ask the far side to announce its classes to us, and our own hub to
+		// announce its classes over the new link. The first frame also tells
+		// the far side our origin before any event arrives.
+		link.queue <- &Envelope{Origin: p.id, Kind: KindSyncRequest}
+		go p.deliver(&Envelope{Origin: p.id, Kind: KindSyncRequest})
+		p.writeLink(conn, link)
+
+		p.mu.Lock()
+		delete(p.links, addr)
+		p.mu.Unlock()
+		conn.Close()
+		p.logger.Warn("Backplane link to " + addr + " lost")
+	}
+}
+
+func (p *Peer) writeLink(conn net.Conn, link *peerLink) {
+	w := bufio.NewWriter(conn)
+	for {
+		select {
+		case env := <-link.queue:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := writeFrame(w, env); err != nil {
+				return
+			}
+			// Coalesce whatever else is queued into the same flush
+			for n := len(link.queue); n > 0; n-- {
+				if err := writeFrame(w, <-link.queue); err != nil {
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// --- Handshake ---
+//
+// Both sides prove they hold the secret without sending it, each over a
+// nonce the other picked so a recorded handshake can't be replayed:
+//
+//	listener -> dialer    nonceL
+//	dialer   -> listener  nonceD, MAC("dial", nonceL, nonceD)
+//	listener -> dialer    MAC("accept", nonceL, nonceD)
+//
+// The dialer checks the reply too, so it doesn't stream class events to
+// whatever happens to answer on a peer's address.
+
+func (p *Peer) mac(label string, nonceL, nonceD []byte) []byte {
+	m := hmac.New(sha256.New, p.secret)
+	m.Write([]byte("saber-backplane/1 " + label + "\n"))
+	m.Write(nonceL)
+	m.Write(nonceD)
+	return m.Sum(nil)
+}
+
+func (p *Peer) acceptHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonceL := make([]byte, nonceSize)
+	rand.Read(nonceL)
+	if _, err := conn.Write(nonceL); err != nil {
+		return err
+	}
+	buf := make([]byte, nonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	nonceD, proof := buf[:nonceSize], buf[nonceSize:]
+	if !hmac.Equal(proof, p.mac("dial", nonceL, nonceD)) {
+		return errors.New("bad secret")
+	}
+	_, err := conn.Write(p.mac("accept", nonceL, nonceD))
+	return err
+}
+
+func (p *Peer) dialHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonceL := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonceL); err != nil {
+		return err
+	}
+	nonceD := make([]byte, nonceSize)
+	rand.Read(nonceD)
+	if _, err := conn.Write(append(nonceD, p.mac("dial", nonceL, nonceD)...)); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, p.mac("accept", nonceL, nonceD)) {
+		return errors.New("bad secret")
+	}
+	return nil
+}
+
+// --- Framing: [u32 header len][header JSON][u32 payload len][payload] ---
+
+func writeFrame(w *bufio.Writer, env *Envelope) error {
+	header, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(header)))
+	w.Write(size[:])
+	w.Write(header)
+	binary.BigEndian.PutUint32(size[:], uint32(len(env.Payload)))
+	w.Write(size[:])
+	_, err = w.Write(env.Payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (*Envelope, error) {
+	header, err := readChunk(r, maxHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(header, &env); err != nil {
+		return nil, err
+	}
+	if env.Payload, err = readChunk(r, maxPayloadSize); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+func readChunk(r *bufio.Reader, limit uint32) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > limit {
+		return nil, errors.New("backplane frame too large")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// localOnly reports whether a listen address can only be reached from this
+// machine. An empty host listens on every interface.
+func localOnly(network, addr string) bool {
+	if network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
@@ -0,0 +1,340 @@
+// Package client is a Go SDK for the Saber WebSocket server, for tools and
+// integration tests that need to act as a student extension or a teacher
+// dashboard. StudentClient and TeacherClient handle the hello handshake,
+// reconnects with backoff, batched frames and the message shapes; callers
+// just send and receive typed messages.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"saber-websocket/models"
+	"saber-websocket/utils"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned by sends while the client is between connections
+var ErrNotConnected = errors.New("client: not connected")
+
+// Config holds the settings shared by students and teachers
+type Config struct {
+	URL       string // e.g. "ws://localhost:8080/"
+	ClassCode string // Empty joins the server's default class
+
+	// Capabilities asked for in hello. Defaults to binary, acks and seq.
+	Capabilities []string
+	// Sent with the upgrade request (e.g. Origin)
+	Header http.Header
+	Dialer *websocket.Dialer
+
+	// Reconnect backoff: doubles from MinBackoff up to MaxBackoff, with jitter
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// How often to send an application ping so the server sees us as alive
+	HeartbeatInterval time.Duration
+
+	Logger *utils.Logger // Optional
+}
+
+func (c *Config) setDefaults() {
+	if c.Capabilities == nil {
+		c.Capabilities = []string{models.CapBinary, models.CapAcks, models.CapSeq}
+	}
+	if c.Dialer == nil {
+		c.Dialer = websocket.DefaultDialer
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = 500 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = 20 * time.Second
+	}
+}
+
+// ServerError is an error message sent by the server
+type ServerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %s: %s", e.Code, e.Message)
+}
+
+// CloseError means the server closed the connection with an application
+// close code that retrying won't fix (replaced, taken over, rejected...).
+// CloseRateLimited and CloseIdentifyTimeout are the exceptions, and reconnect.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed by server: %d %s", e.Code, e.Reason)
+}
+
+// Errors during connect that no amount of reconnecting fixes
+var fatalErrorCodes = map[string]bool{
+	"auth_required":       true,
+	"auth_failed":         true,
+	"forbidden":           true,
+	"invalid_class_code":  true,
+	"invalid_message":     true, // Resending the same connect won't help
+	"unsupported_version": true,
+}
+
+// role is what differs between a student and a teacher session
+type role interface {
+	// connectMessage is sent right after hello; registered reports whether a
+	// message is the server's confirmation of it
+	connectMessage() interface{}
+	registered(msg *Message) bool
+	handle(msg *Message)
+	handleFrame(frame *models.ScreenshotFrame)
+}
+
+// session is one logical client across any number of connections
+type session struct {
+	cfg  Config
+	role role
+
+	mu   sync.Mutex // Guards conn and serializes writes
+	conn *websocket.Conn
+	caps map[string]bool
+
+	reconnectHint time.Duration // From server_shutdown
+}
+
+func newSession(cfg Config, r role) *session {
+	cfg.setDefaults()
+	return &session{cfg: cfg, role: r}
+}
+
+// run connects and reconnects until ctx is done or the server refuses us
+// for good
+func (s *session) run(ctx context.Context) error {
+	backoff := s.cfg.MinBackoff
+	for {
+		started := time.Now()
+		err := s.connectOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A connection that lasted a while starts the backoff over
+		if time.Since(started) > s.cfg.MaxBackoff {
+			backoff = s.cfg.MinBackoff
+		}
+
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) && fatalErrorCodes[serverErr.Code] {
+			return err
+		}
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			switch closeErr.Code {
+			case models.CloseRateLimited:
+				// Disconnected for flooding: come back, but slowly
+				backoff = s.cfg.MaxBackoff
+			case models.CloseIdentifyTimeout:
+				// Our connect message got stuck somewhere; just try again
+			default:
+				return err
+			}
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		if s.reconnectHint > 0 {
+			wait, s.reconnectHint = s.reconnectHint, 0
+		}
+		s.logf("Reconnecting in %s: %v", wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+	}
+}
+
+// connectOnce dials, negotiates, registers and then reads until the
+// connection drops
+func (s *session) connectOnce(ctx context.Context) error {
+	conn, _, err := s.cfg.Dialer.DialContext(ctx, s.cfg.URL, s.cfg.Header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock the reads below when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type": "hello",
+		"data": map[string]interface{}{
+			"version":      models.MaxProtocol,
+			"capabilities": s.cfg.Capabilities,
+		},
+	}); err != nil {
+		return err
+	}
+	if err := conn.WriteJSON(s.role.connectMessage()); err != nil {
+		return err
+	}
+
+	// Handshake: hello_ack, then the registration confirmation
+	registered := false
+	for !registered {
+		msgs, frames, err := readFrame(conn)
+		if err != nil {
+			return closeError(err)
+		}
+		for _, frame := range frames {
+			s.role.handleFrame(frame)
+		}
+		for _, msg := range msgs {
+			switch {
+			case msg.Type == "hello_ack":
+				s.setCapabilities(msg)
+			case msg.Type == "error":
+				serverErr := &ServerError{}
+				json.Unmarshal(msg.raw, serverErr)
+				if fatalErrorCodes[serverErr.Code] {
+					return serverErr
+				}
+				// Anything else is the role's to report; if the server gives
+				// up on us, its close code says so
+				s.role.handle(msg)
+			case s.role.registered(msg):
+				// Open for sends before the callback, so it can send straight away
+				registered = true
+				s.setConn(conn)
+				defer s.setConn(nil)
+				s.role.handle(msg)
+			default:
+				s.role.handle(msg)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.heartbeat(done)
+
+	for {
+		msgs, frames, err := readFrame(conn)
+		if err != nil {
+			return closeError(err)
+		}
+		for _, frame := range frames {
+			s.role.handleFrame(frame)
+		}
+		for _, msg := range msgs {
+			if msg.Type == "server_shutdown" {
+				var hint struct {
+					ReconnectAfterMs int64 `json:"reconnectAfterMs"`
+				}
+				json.Unmarshal(msg.Data, &hint)
+				s.reconnectHint = time.Duration(hint.ReconnectAfterMs) * time.Millisecond
+			}
+			s.role.handle(msg)
+		}
+	}
+}
+
+// heartbeat pings the server until done is closed
+func (s *session) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(s.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.send(map[string]interface{}{"type": "ping"})
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *session) setConn(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+}
+
+func (s *session) setCapabilities(msg *Message) {
+	var ack struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	json.Unmarshal(msg.Data, &ack)
+	caps := make(map[string]bool, len(ack.Capabilities))
+	for _, name := range ack.Capabilities {
+		caps[name] = true
+	}
+	s.mu.Lock()
+	s.caps = caps
+	s.mu.Unlock()
+}
+
+// hasCapability reports whether the server agreed to a capability
+func (s *session) hasCapability(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caps[name]
+}
+
+// send writes one JSON message on the current connection
+func (s *session) send(v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return ErrNotConnected
+	}
+	return s.conn.WriteJSON(v)
+}
+
+// sendBinary writes one binary frame on the current connection
+func (s *session) sendBinary(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return ErrNotConnected
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// close ends the current connection; run reconnects unless ctx is done
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *session) logf(format string, v ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Infof(format, v...)
+	}
+}
+
+// closeError turns the server's application close codes into a CloseError
+func closeError(err error) error {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) && ce.Code >= 4000 && ce.Code < 5000 {
+		return &CloseError{Code: ce.Code, Reason: ce.Text}
+	}
+	return err
+}
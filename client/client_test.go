@@ -0,0 +1,405 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"saber-websocket/config"
+	"saber-websocket/handlers"
+	"saber-websocket/models"
+	"saber-websocket/server"
+	"saber-websocket/utils"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testServer runs the real handlers and returns the WebSocket URL
+func testServer(t *testing.T, configure func(cfg *config.Config)) string {
+	_, url := testHub(t, configure)
+	return url
+}
+
+// testHub is testServer for tests that also look at the server side. Its
+// sockets have small send buffers, so a peer that stops reading soon holds
+// up the server's writes.
+func testHub(t *testing.T, configure func(cfg *config.Config)) (*server.Hub, string) {
+	t.Helper()
+	cfg := config.LoadConfig()
+	cfg.AllowInsecureTeachers = true
+	if configure != nil {
+		configure(cfg)
+	}
+	logger := utils.NewLogger()
+	logger.SetLevel(utils.ERROR)
+	hub := server.NewHub(cfg, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.Run(ctx)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.ServeWs(hub, w, r, cfg, logger)
+	}))
+	srv.Listener = smallBuffers{srv.Listener}
+	srv.Start()
+	t.Cleanup(func() {
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		hub.Shutdown(shutdownCtx)
+		cancel()
+		srv.Close()
+	})
+	return hub, "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+}
+
+type smallBuffers struct {
+	net.Listener
+}
+
+func (l smallBuffers) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(4096)
+	}
+	return conn, err
+}
+
+// start runs a client until the test ends; Run's error arrives on the
+// returned channel if it gives up first
+func start(t *testing.T, run func(ctx context.Context) error) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		result <- run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return result
+}
+
+// receive waits for the next value from a callback
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func fastReconnect(url string) Config {
+	return Config{URL: url, ClassCode: "C1", MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+}
+
+func TestConnect(t *testing.T) {
+	url := testServer(t, nil)
+
+	roles := make(chan string, 1)
+	rosters := make(chan []Student, 1)
+	joined := make(chan Student, 1)
+	teacher := NewTeacherClient(TeacherConfig{
+		Config:             fastReconnect(url),
+		OnRegistered:       func(role string) { roles <- role },
+		OnStudentList:      func(students []Student) { rosters <- students },
+		OnStudentConnected: func(s Student) { joined <- s },
+	})
+	start(t, teacher.Run)
+	if role := receive(t, roles, "teacher_registered"); role != models.RoleOwner {
+		t.Errorf("teacher registered as %s, want %s", role, models.RoleOwner)
+	}
+	if roster := receive(t, rosters, "initial_student_list"); len(roster) != 0 {
+		t.Errorf("roster %+v, want an empty class", roster)
+	}
+
+	regs := make(chan Registered, 1)
+	student := NewStudentClient(StudentConfig{
+		Config:       fastReconnect(url),
+		ClientID:     "s1",
+		Email:        "s1@example.com",
+		OnRegistered: func(reg Registered) { regs <- reg },
+	})
+	start(t, student.Run)
+	reg := receive(t, regs, "student_registered")
+	if reg.ClientID != "s1" || reg.ClassCode != "C1" || reg.Resumed || reg.ResumeWindow <= 0 {
+		t.Errorf("student registered as %+v", reg)
+	}
+	if s := receive(t, joined, "student_connected"); s.ClientID != "s1" || s.Email != "s1@example.com" {
+		t.Errorf("student_connected %+v", s)
+	}
+	if !student.session.hasCapability(models.CapAcks) || !student.session.hasCapability(models.CapSeq) {
+		t.Errorf("negotiated %v, want acks and seq", student.session.caps)
+	}
+}
+
+// The SDK's frame reader against what the server actually sends in each
+// framing mode. The dashboard holds off reading behind a large screenshot
+// until a burst of tab events has queued up, so they go out in batches.
+func TestFraming(t *testing.T) {
+	hub, url := testHub(t, nil)
+	const events = 50
+
+	for _, framing := range []string{models.FramingNewline, models.FramingArray, models.FramingLengthPrefixed} {
+		t.Run(framing, func(t *testing.T) {
+			class := "frame-" + strings.ReplaceAll(framing, "_", "-")
+			dashboard, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dashboard.Close()
+			dashboard.WriteJSON(map[string]interface{}{
+				"type": "hello",
+				"data": map[string]interface{}{
+					"version":      models.MaxProtocol,
+					"capabilities": []string{models.CapBinary},
+					"framing":      framing,
+				},
+			})
+			dashboard.WriteJSON(map[string]interface{}{
+				"type": "teacher_connect",
+				"data": map[string]interface{}{"classCode": class},
+			})
+			// The events are only relayed once the dashboard is in the class
+			dashboard.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for registered := false; !registered; {
+				msgs, _, err := readFrame(dashboard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, msg := range msgs {
+					registered = registered || msg.Type == "teacher_registered"
+				}
+			}
+
+			regs := make(chan Registered, 1)
+			received := make(chan string, 1)
+			cfg := fastReconnect(url)
+			cfg.ClassCode = class
+			student := NewStudentClient(StudentConfig{
+				Config:       cfg,
+				ClientID:     "s1",
+				OnRegistered: func(reg Registered) { regs <- reg },
+				OnMessage:    func(msg *Message) { received <- msg.Type },
+			})
+			start(t, student.Run)
+			receive(t, regs, "student_registered")
+
+			// Too big for the socket buffers, so the dashboard's writes stall
+			// until it reads and the events pile up behind it
+			image := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1<<20)...)
+			if err := student.SendScreenshot(7, image); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < events; i++ {
+				if err := student.SendTabEvent("tab_updated", map[string]interface{}{"tabId": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The pong means the server has read every event and handed it to
+			// the class loop; a message through that loop back to the
+			// student means it has queued them all for the dashboard
+			student.session.send(map[string]interface{}{"type": "ping"})
+			if typ := receive(t, received, "pong"); typ != "pong" {
+				t.Fatalf("got %s, want pong", typ)
+			}
+			hub.Broadcast(&models.BroadcastMessage{ClassCode: class, Target: "s1", Message: []byte(`{"type":"marker"}`)})
+			if typ := receive(t, received, "marker"); typ != "marker" {
+				t.Fatalf("got %s, want marker", typ)
+			}
+
+			dashboard.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var shots []*models.ScreenshotFrame
+			frames, largest := 0, 0
+			for next := 0; next < events; {
+				msgs, got, err := readFrame(dashboard)
+				if err != nil {
+					t.Fatalf("after %d of %d events: %v", next, events, err)
+				}
+				shots = append(shots, got...)
+				frames++
+				if len(msgs) > largest {
+					largest = len(msgs)
+				}
+				for _, msg := range msgs {
+					if msg.Type != "student_tab_updated" {
+						continue
+					}
+					var relay relayData
+					var tab struct {
+						TabID int `json:"tabId"`
+					}
+					json.Unmarshal(msg.Data, &relay)
+					json.Unmarshal(relay.Payload, &tab)
+					if relay.ClientID != "s1" || tab.TabID != next {
+						t.Fatalf("event %d: got %s from %s", next, relay.Payload, relay.ClientID)
+					}
+					next++
+				}
+			}
+			if len(shots) != 1 || shots[0].ClientID != "s1" || shots[0].TabID != 7 || len(shots[0].Image) != len(image) {
+				t.Errorf("screenshots %+v, want the one s1 sent", shots)
+			}
+			if largest < 2 {
+				t.Errorf("%d frames with at most %d message each; nothing was batched", frames, largest)
+			}
+		})
+	}
+}
+
+// A dropped socket comes back to the same slot with the resume token
+func TestResumeAfterDrop(t *testing.T) {
+	url := testServer(t, nil)
+
+	roles := make(chan string, 1)
+	disconnected := make(chan string, 1)
+	teacher := NewTeacherClient(TeacherConfig{
+		Config:                fastReconnect(url),
+		OnRegistered:          func(role string) { roles <- role },
+		OnStudentDisconnected: func(id string) { disconnected <- id },
+	})
+	start(t, teacher.Run)
+	receive(t, roles, "teacher_registered")
+
+	regs := make(chan Registered, 2)
+	student := NewStudentClient(StudentConfig{
+		Config:       fastReconnect(url),
+		ClientID:     "s1",
+		OnRegistered: func(reg Registered) { regs <- reg },
+	})
+	start(t, student.Run)
+	first := receive(t, regs, "student_registered")
+	token := student.resumeToken
+
+	student.Disconnect()
+	again := receive(t, regs, "student_registered after the drop")
+	if !again.Resumed || again.ClientID != first.ClientID {
+		t.Errorf("after the drop: %+v, want %s resumed", again, first.ClientID)
+	}
+	if student.resumeToken == token {
+		t.Error("resume token was not rotated")
+	}
+	select {
+	case id := <-disconnected:
+		t.Errorf("teacher saw %s disconnect across a resume", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCommandAckAndResult(t *testing.T) {
+	url := testServer(t, nil)
+
+	regs := make(chan Registered, 1)
+	received := make(chan Command, 1)
+	student := NewStudentClient(StudentConfig{
+		Config:       fastReconnect(url),
+		ClientID:     "s1",
+		OnRegistered: func(reg Registered) { regs <- reg },
+		OnCommand: func(cmd Command) (interface{}, error) {
+			received <- cmd
+			if cmd.Name == "fail" {
+				return nil, errors.New("no such tab")
+			}
+			return map[string]interface{}{"closed": 3}, nil
+		},
+	})
+	start(t, student.Run)
+	receive(t, regs, "student_registered")
+
+	roles := make(chan string, 1)
+	statuses := make(chan CommandStatus, 8)
+	teacher := NewTeacherClient(TeacherConfig{
+		Config:          fastReconnect(url),
+		OnRegistered:    func(role string) { roles <- role },
+		OnCommandStatus: func(status CommandStatus) { statuses <- status },
+	})
+	start(t, teacher.Run)
+	receive(t, roles, "teacher_registered")
+
+	cases := []struct {
+		command string
+		final   string
+		result  string
+	}{
+		{"close_all_tabs", "completed", `{"closed":3}`},
+		{"fail", "failed", ""},
+	}
+	for _, c := range cases {
+		requestID, err := teacher.SendCommand("s1", c.command, map[string]interface{}{"force": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := receive(t, received, c.command)
+		if cmd.Name != c.command || cmd.ID == "" || string(cmd.Data) != `{"force":true}` {
+			t.Errorf("student got %+v", cmd)
+		}
+
+		var states []string
+		for len(states) == 0 || states[len(states)-1] != c.final {
+			status := receive(t, statuses, fmt.Sprintf("%s after %v", c.command, states))
+			if status.RequestID != requestID || status.CommandID != cmd.ID || status.TargetClientID != "s1" {
+				t.Errorf("%s: status %+v for another command", c.command, status)
+			}
+			states = append(states, status.State)
+			if status.State == c.final && c.result != "" && string(status.Result) != c.result {
+				t.Errorf("%s: result %s, want %s", c.command, status.Result, c.result)
+			}
+		}
+		want := []string{"delivered", "acknowledged", c.final}
+		if fmt.Sprint(states) != fmt.Sprint(want) {
+			t.Errorf("%s: states %v, want %v", c.command, states, want)
+		}
+	}
+}
+
+// Only the fatal codes end Run during the handshake; other errors reach the
+// callbacks and the close code decides
+func TestErrorBeforeRegistration(t *testing.T) {
+	url := testServer(t, func(cfg *config.Config) {
+		cfg.DuplicateClientPolicy = config.DuplicateReject
+	})
+
+	regs := make(chan Registered, 1)
+	first := NewStudentClient(StudentConfig{
+		Config:       fastReconnect(url),
+		ClientID:     "s1",
+		OnRegistered: func(reg Registered) { regs <- reg },
+	})
+	start(t, first.Run)
+	receive(t, regs, "student_registered")
+
+	errs := make(chan *Message, 1)
+	second := NewStudentClient(StudentConfig{
+		Config:    fastReconnect(url),
+		ClientID:  "s1",
+		OnMessage: func(msg *Message) { errs <- msg },
+	})
+	err := receive(t, start(t, second.Run), "Run to return")
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != models.CloseRejected {
+		t.Errorf("Run = %v, want a CloseError %d", err, models.CloseRejected)
+	}
+	msg := receive(t, errs, "the error message")
+	var reply ServerError
+	json.Unmarshal(msg.raw, &reply)
+	if msg.Type != "error" || reply.Code != "duplicate_client" {
+		t.Errorf("OnMessage got %s", msg.raw)
+	}
+
+	// A fatal code still stops Run at once
+	teacher := NewTeacherClient(TeacherConfig{Config: fastReconnect(url), Token: "not-a-jwt"})
+	err = receive(t, start(t, teacher.Run), "Run to return")
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || !fatalErrorCodes[serverErr.Code] {
+		t.Errorf("Run with a bad token = %v, want a fatal ServerError", err)
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"saber-websocket/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message is one server message, with its data left encoded
+type Message struct {
+	Type string          `json:"type"`
+	Seq  uint64          `json:"seq,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Commands sent to students have no type
+	Command   string `json:"command,omitempty"`
+	CommandID string `json:"commandId,omitempty"`
+
+	raw []byte
+}
+
+var errBadBatch = errors.New("client: malformed batch frame")
+
+// readFrame reads one WebSocket frame and splits it into messages and
+// screenshot frames. It understands every framing mode: newline-joined JSON
+// (the legacy default), JSON arrays and length-prefixed binary batches.
+func readFrame(conn *websocket.Conn) ([]*Message, []*models.ScreenshotFrame, error) {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items [][]byte
+	switch {
+	case messageType == websocket.BinaryMessage:
+		if items, err = splitBinary(data); err != nil {
+			return nil, nil, err
+		}
+	case len(data) > 0 && data[0] == '[':
+		var array []json.RawMessage
+		if err := json.Unmarshal(data, &array); err != nil {
+			return nil, nil, err
+		}
+		for _, item := range array {
+			items = append(items, item)
+		}
+	default:
+		items = bytes.Split(data, []byte{'\n'})
+	}
+
+	var msgs []*Message
+	var frames []*models.ScreenshotFrame
+	for _, item := range items {
+		if models.IsBinaryFrame(item) {
+			frame, err := models.DecodeScreenshotFrame(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			frames = append(frames, frame)
+			continue
+		}
+		if len(bytes.TrimSpace(item)) == 0 {
+			continue
+		}
+		msg := &Message{raw: item}
+		if err := json.Unmarshal(item, msg); err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, frames, nil
+}
+
+// splitBinary unpacks a binary frame: a screenshot frame or a batch of
+// messages. The SDK only speaks JSON, so there are no codec messages.
+func splitBinary(data []byte) ([][]byte, error) {
+	if !models.IsBinaryFrame(data) || len(data) < 3 {
+		return nil, errBadBatch
+	}
+	if data[2] != models.FrameBatch {
+		return [][]byte{data}, nil
+	}
+	var items [][]byte
+	for rest := data[3:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, errBadBatch
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)-4) < uint64(n) {
+			return nil, errBadBatch
+		}
+		items = append(items, rest[4:4+n])
+		rest = rest[4+n:]
+	}
+	return items, nil
+}
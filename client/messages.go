@@ -0,0 +1,82 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Student is one entry of a dashboard's roster
+type Student struct {
+	ClientID string `json:"clientId"`
+	Email    string `json:"email"`
+	Presence string `json:"presence,omitempty"` // Empty for detached and remote students
+}
+
+// StudentResync replaces what a dashboard knew about one student after the
+// server dropped numbered messages about them
+type StudentResync struct {
+	ClientID string                 `json:"clientId"`
+	State    string                 `json:"state"` // connected, reconnecting or disconnected
+	Email    string                 `json:"email"`
+	Presence string                 `json:"presence"`
+	Tabs     map[string]interface{} `json:"tabs"`
+	Remote   bool                   `json:"remote"` // Tabs live on another instance
+	Missed   [][2]uint64            `json:"missed"`
+}
+
+// TabEvent is a tab change relayed from a student: Kind is the student's
+// message type (tabs_update, tab_created, tab_updated, tab_removed,
+// screenshot_error or screenshot_skipped) and Payload is what it sent
+type TabEvent struct {
+	ClientID string
+	Kind     string
+	Payload  json.RawMessage
+}
+
+// Screenshot is a tab capture from a student, from either a binary frame or
+// a legacy data URL
+type Screenshot struct {
+	ClientID  string
+	TabID     int64
+	Timestamp time.Time
+	Image     []byte
+}
+
+// CommandStatus tracks a command sent with TeacherClient.SendCommand
+type CommandStatus struct {
+	CommandID      string          `json:"commandId"`
+	RequestID      string          `json:"requestId"`
+	TargetClientID string          `json:"targetClientId"`
+	Command        string          `json:"command"`
+	State          string          `json:"state"`  // delivered, acknowledged, completed, failed, timed_out or denied
+	Reason         string          `json:"reason"` // For denied, the policy's reason (e.g. role_not_allowed)
+	Result         json.RawMessage `json:"result,omitempty"`
+}
+
+// Presence is a student_presence transition
+type Presence struct {
+	ClientID       string `json:"clientId"`
+	State          string `json:"state"`
+	Previous       string `json:"previous"`
+	Since          int64  `json:"since"`
+	LastSeen       int64  `json:"lastSeen"`
+	LastActivityAt int64  `json:"lastActivityAt"`
+}
+
+// relayData is the envelope the server wraps student messages in
+type relayData struct {
+	ClientID string          `json:"clientId"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// decodeDataURL extracts the bytes of a base64 data URL
+func decodeDataURL(s string) ([]byte, bool) {
+	i := strings.Index(s, ";base64,")
+	if !strings.HasPrefix(s, "data:") || i < 0 {
+		return nil, false
+	}
+	image, err := base64.StdEncoding.DecodeString(s[i+len(";base64,"):])
+	return image, err == nil
+}
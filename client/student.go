@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"saber-websocket/models"
+	"time"
+)
+
+// StudentConfig configures a StudentClient
+type StudentConfig struct {
+	Config
+
+	ClientID        string
+	Email           string
+	EnrollmentToken string // Required when the server runs in enrollment mode
+
+	// OnCommand runs a teacher command. With acks negotiated the SDK sends
+	// command_ack before calling it and command_result with what it returns.
+	// Called on its own goroutine.
+	OnCommand func(cmd Command) (result interface{}, err error)
+	// OnRegistered is called after every (re)registration
+	OnRegistered func(reg Registered)
+	// OnMessage receives every other server message
+	OnMessage func(msg *Message)
+}
+
+// Command is a teacher command delivered to a student
+type Command struct {
+	ID   string // Empty when the server doesn't track acks
+	Name string
+	Data json.RawMessage
+}
+
+// Registered is the server's student_registered confirmation
+type Registered struct {
+	ClassCode    string
+	ClientID     string
+	Resumed      bool // Took over the slot of a dropped connection
+	ResumeWindow time.Duration
+}
+
+// StudentClient acts as a student's browser extension
+type StudentClient struct {
+	cfg         StudentConfig
+	session     *session
+	resumeToken string // Only touched by the session goroutine
+}
+
+// NewStudentClient creates a student client; call Run to connect
+func NewStudentClient(cfg StudentConfig) *StudentClient {
+	s := &StudentClient{cfg: cfg}
+	s.session = newSession(cfg.Config, s)
+	return s
+}
+
+// Run connects and keeps reconnecting (resuming the same slot) until ctx is
+// done or the server refuses the student for good
+func (s *StudentClient) Run(ctx context.Context) error {
+	return s.session.run(ctx)
+}
+
+// Disconnect drops the current connection; Run reconnects and resumes
+func (s *StudentClient) Disconnect() {
+	s.session.close()
+}
+
+// SendTabs sends the full set of open tabs
+func (s *StudentClient) SendTabs(tabs map[string]interface{}) error {
+	return s.session.send(map[string]interface{}{
+		"type": "tabs_update",
+		"data": map[string]interface{}{"tabs": tabs},
+	})
+}
+
+// SendTabEvent sends a single tab change: "tab_created", "tab_updated" or "tab_removed"
+func (s *StudentClient) SendTabEvent(kind string, data interface{}) error {
+	return s.session.send(map[string]interface{}{
+		"type": kind,
+		"data": data,
+	})
+}
+
+// SendScreenshot sends a capture of a tab, as a binary frame when the server
+// agreed to it and as a base64 data URL otherwise
+func (s *StudentClient) SendScreenshot(tabID int64, image []byte) error {
+	if s.session.hasCapability(models.CapBinary) {
+		frame, err := models.EncodeScreenshotFrame(&models.ScreenshotFrame{
+			TabID:     tabID,
+			Timestamp: time.Now().UnixMilli(),
+			Image:     image,
+		})
+		if err != nil {
+			return err
+		}
+		return s.session.sendBinary(frame)
+	}
+	return s.session.send(map[string]interface{}{
+		"type": "screenshot",
+		"data": map[string]interface{}{
+			"tabId":     tabID,
+			"imageData": "data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image),
+		},
+	})
+}
+
+// SendActivity reports the browser's idle state: "active", "idle" or "locked"
+func (s *StudentClient) SendActivity(state string, lastInput time.Time) error {
+	data := map[string]interface{}{"state": state}
+	if !lastInput.IsZero() {
+		data["lastInputAt"] = lastInput.UnixMilli()
+	}
+	return s.session.send(map[string]interface{}{
+		"type": "activity",
+		"data": data,
+	})
+}
+
+func (s *StudentClient) connectMessage() interface{} {
+	data := map[string]interface{}{
+		"clientId": s.cfg.ClientID,
+		"email":    s.cfg.Email,
+	}
+	if s.cfg.ClassCode != "" {
+		data["classCode"] = s.cfg.ClassCode
+	}
+	if s.cfg.EnrollmentToken != "" {
+		data["enrollmentToken"] = s.cfg.EnrollmentToken
+	}
+	if s.resumeToken != "" {
+		data["resumeToken"] = s.resumeToken
+	}
+	return map[string]interface{}{
+		"type": "student_connect",
+		"data": data,
+	}
+}
+
+func (s *StudentClient) registered(msg *Message) bool {
+	return msg.Type == "student_registered"
+}
+
+func (s *StudentClient) handle(msg *Message) {
+	switch {
+	case msg.Type == "" && msg.Command != "":
+		s.runCommand(Command{ID: msg.CommandID, Name: msg.Command, Data: msg.Data})
+
+	case msg.Type == "student_registered":
+		var reg struct {
+			ClassCode      string `json:"classCode"`
+			ClientID       string `json:"clientId"`
+			ResumeToken    string `json:"resumeToken"`
+			Resumed        bool   `json:"resumed"`
+			ResumeWindowMs int64  `json:"resumeWindowMs"`
+		}
+		json.Unmarshal(msg.Data, &reg)
+		s.resumeToken = reg.ResumeToken
+		if s.cfg.OnRegistered != nil {
+			s.cfg.OnRegistered(Registered{
+				ClassCode:    reg.ClassCode,
+				ClientID:     reg.ClientID,
+				Resumed:      reg.Resumed,
+				ResumeWindow: time.Duration(reg.ResumeWindowMs) * time.Millisecond,
+			})
+		}
+
+	case s.cfg.OnMessage != nil:
+		s.cfg.OnMessage(msg)
+	}
+}
+
+// runCommand acks a command, runs the callback and reports its result
+func (s *StudentClient) runCommand(cmd Command) {
+	tracked := cmd.ID != "" && s.session.hasCapability(models.CapAcks)
+	if tracked {
+		s.session.send(map[string]interface{}{
+			"type": "command_ack",
+			"data": map[string]interface{}{"commandId": cmd.ID},
+		})
+	}
+	if s.cfg.OnCommand == nil {
+		return
+	}
+	go func() {
+		result, err := s.cfg.OnCommand(cmd)
+		if !tracked {
+			return
+		}
+		data := map[string]interface{}{"commandId": cmd.ID}
+		if err != nil {
+			data["error"] = err.Error()
+		} else if result != nil {
+			data["result"] = result
+		}
+		s.session.send(map[string]interface{}{
+			"type": "command_result",
+			"data": data,
+		})
+	}()
+}
+
+// Students never receive screenshots
+func (s *StudentClient) handleFrame(frame *models.ScreenshotFrame) {}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"saber-websocket/models"
+	"strings"
+	"time"
+)
+
+// TeacherConfig configures a TeacherClient. Callbacks run on the read loop,
+// so they should return quickly.
+type TeacherConfig struct {
+	Config
+
+	Token string // Teacher JWT; may be empty on servers that allow insecure teachers
+
+	// OnRegistered is called after every (re)registration with the role the
+	// server granted (owner, co_teacher or observer)
+	OnRegistered func(role string)
+	// OnStudentList receives the full roster on every (re)connect, and again
+	// if the server had to drop roster updates
+	OnStudentList         func(students []Student)
+	OnStudentResync       func(resync StudentResync)
+	OnStudentConnected    func(student Student)
+	OnStudentDisconnected func(clientID string)
+	OnTabEvent            func(event TabEvent)
+	OnScreenshot          func(shot Screenshot)
+	OnCommandStatus       func(status CommandStatus)
+	OnPresence            func(presence Presence)
+	// OnMessage receives every other server message
+	OnMessage func(msg *Message)
+}
+
+// TeacherClient acts as a teacher dashboard
+type TeacherClient struct {
+	cfg     TeacherConfig
+	session *session
+}
+
+// NewTeacherClient creates a teacher client; call Run to connect
+func NewTeacherClient(cfg TeacherConfig) *TeacherClient {
+	t := &TeacherClient{cfg: cfg}
+	t.session = newSession(cfg.Config, t)
+	return t
+}
+
+// Run connects and keeps reconnecting until ctx is done or the server
+// refuses the dashboard for good
+func (t *TeacherClient) Run(ctx context.Context) error {
+	return t.session.run(ctx)
+}
+
+// Disconnect drops the current connection; Run reconnects
+func (t *TeacherClient) Disconnect() {
+	t.session.close()
+}
+
+// SendCommand sends a command to a student and returns the request ID that
+// the command's status updates carry
+func (t *TeacherClient) SendCommand(targetClientID, command string, data interface{}) (string, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	requestID := hex.EncodeToString(b[:])
+	err := t.session.send(map[string]interface{}{
+		"type": "teacher_command",
+		"data": map[string]interface{}{
+			"targetClientId": targetClientID,
+			"command":        command,
+			"data":           data,
+			"requestId":      requestID,
+		},
+	})
+	return requestID, err
+}
+
+// Broadcast sends a command to every student in the class. Broadcasts get no
+// status updates.
+func (t *TeacherClient) Broadcast(command string, data interface{}) error {
+	return t.session.send(map[string]interface{}{
+		"type": "teacher_broadcast",
+		"data": map[string]interface{}{
+			"command": command,
+			"data":    data,
+		},
+	})
+}
+
+// Kick disconnects a student; the reason is passed on to it
+func (t *TeacherClient) Kick(targetClientID, reason string) error {
+	return t.session.send(map[string]interface{}{
+		"type": "teacher_kick",
+		"data": map[string]interface{}{
+			"targetClientId": targetClientID,
+			"reason":         reason,
+		},
+	})
+}
+
+func (t *TeacherClient) connectMessage() interface{} {
+	data := map[string]interface{}{}
+	if t.cfg.ClassCode != "" {
+		data["classCode"] = t.cfg.ClassCode
+	}
+	if t.cfg.Token != "" {
+		data["token"] = t.cfg.Token
+	}
+	return map[string]interface{}{
+		"type": "teacher_connect",
+		"data": data,
+	}
+}
+
+func (t *TeacherClient) registered(msg *Message) bool {
+	return msg.Type == "teacher_registered"
+}
+
+func (t *TeacherClient) handle(msg *Message) {
+	switch msg.Type {
+	case "teacher_registered":
+		var reg struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(msg.Data, &reg)
+		if t.cfg.OnRegistered != nil {
+			t.cfg.OnRegistered(reg.Role)
+		}
+
+	case "initial_student_list":
+		var students []Student
+		if json.Unmarshal(msg.Data, &students) == nil && t.cfg.OnStudentList != nil {
+			t.cfg.OnStudentList(students)
+		}
+
+	case "student_resync":
+		var resync StudentResync
+		if json.Unmarshal(msg.Data, &resync) == nil && t.cfg.OnStudentResync != nil {
+			t.cfg.OnStudentResync(resync)
+		}
+
+	case "student_connected":
+		var student Student
+		if json.Unmarshal(msg.Data, &student) == nil && t.cfg.OnStudentConnected != nil {
+			t.cfg.OnStudentConnected(student)
+		}
+
+	case "student_disconnected":
+		var student Student
+		if json.Unmarshal(msg.Data, &student) == nil && t.cfg.OnStudentDisconnected != nil {
+			t.cfg.OnStudentDisconnected(student.ClientID)
+		}
+
+	case "student_screenshot":
+		t.handleLegacyScreenshot(msg)
+
+	case "student_tabs_update", "student_tab_created", "student_tab_updated", "student_tab_removed",
+		"student_screenshot_error", "student_screenshot_skipped":
+		var relay relayData
+		if json.Unmarshal(msg.Data, &relay) == nil && t.cfg.OnTabEvent != nil {
+			t.cfg.OnTabEvent(TabEvent{
+				ClientID: relay.ClientID,
+				Kind:     strings.TrimPrefix(msg.Type, "student_"),
+				Payload:  relay.Payload,
+			})
+		}
+
+	case "command_status":
+		var status CommandStatus
+		if json.Unmarshal(msg.Data, &status) == nil && t.cfg.OnCommandStatus != nil {
+			t.cfg.OnCommandStatus(status)
+		}
+
+	case "command_failed":
+		// Only sent when acks weren't negotiated, so there are no IDs
+		var failed CommandStatus
+		if json.Unmarshal(msg.Data, &failed) == nil && t.cfg.OnCommandStatus != nil {
+			failed.State = "failed"
+			t.cfg.OnCommandStatus(failed)
+		}
+
+	case "error":
+		// Commands refused by the server's policy never get a commandId;
+		// report them against their requestId instead
+		var reply struct {
+			Code string        `json:"code"`
+			Data CommandStatus `json:"data"`
+		}
+		if json.Unmarshal(msg.raw, &reply) == nil && reply.Code == "command_denied" && t.cfg.OnCommandStatus != nil {
+			reply.Data.State = "denied"
+			t.cfg.OnCommandStatus(reply.Data)
+		} else if t.cfg.OnMessage != nil {
+			t.cfg.OnMessage(msg)
+		}
+
+	case "student_presence":
+		var presence Presence
+		if json.Unmarshal(msg.Data, &presence) == nil && t.cfg.OnPresence != nil {
+			t.cfg.OnPresence(presence)
+		}
+
+	default:
+		if t.cfg.OnMessage != nil {
+			t.cfg.OnMessage(msg)
+		}
+	}
+}
+
+// handleLegacyScreenshot decodes the data URL form sent to dashboards
+// without the binary capability
+func (t *TeacherClient) handleLegacyScreenshot(msg *Message) {
+	if t.cfg.OnScreenshot == nil {
+		return
+	}
+	var relay relayData
+	var shot struct {
+		TabID     int64  `json:"tabId"`
+		ImageData string `json:"imageData"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if json.Unmarshal(msg.Data, &relay) != nil || json.Unmarshal(relay.Payload, &shot) != nil {
+		return
+	}
+	image, ok := decodeDataURL(shot.ImageData)
+	if !ok {
+		return
+	}
+	ts := time.Now()
+	if shot.Timestamp > 0 {
+		ts = time.UnixMilli(shot.Timestamp)
+	}
+	t.cfg.OnScreenshot(Screenshot{
+		ClientID:  relay.ClientID,
+		TabID:     shot.TabID,
+		Timestamp: ts,
+		Image:     image,
+	})
+}
+
+func (t *TeacherClient) handleFrame(frame *models.ScreenshotFrame) {
+	if t.cfg.OnScreenshot != nil {
+		t.cfg.OnScreenshot(Screenshot{
+			ClientID:  frame.ClientID,
+			TabID:     frame.TabID,
+			Timestamp: time.UnixMilli(frame.Timestamp),
+			Image:     frame.Image,
+		})
+	}
+}
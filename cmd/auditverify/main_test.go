@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"saber-websocket/audit"
+	"saber-websocket/utils"
+	"strings"
+	"testing"
+)
+
+func writeLog(t *testing.T, n int) (path, head string) {
+	t.Helper()
+	path = filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path, "test", utils.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		l.Record(audit.Entry{Event: audit.EventCommand, ClassCode: "C1", TeacherID: "t1", Command: "lock_screen"})
+	}
+	_, head = l.Head()
+	l.Close()
+	return path, head
+}
+
+func rewrite(t *testing.T, path string, change func(lines []string) []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := change(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(lines []string) []string
+		head   bool // pass the original head with -head
+		status int
+		output string
+	}{
+		{"intact", nil, false, 0, "OK: 3 entries"},
+		{"intact with head", nil, true, 0, "OK: 3 entries"},
+		{"edited entry", func(l []string) []string {
+			l[1] = strings.Replace(l[1], "lock_screen", "open_tab", 1)
+			return l
+		}, false, 1, "TAMPERED: line 2 (seq 2): contents do not match the hash (1 good entries before it)"},
+		{"deleted entry", func(l []string) []string {
+			return append(l[:1], l[2:]...)
+		}, false, 1, "TAMPERED: line 2 (seq 3): expected seq 2"},
+		{"reordered entries", func(l []string) []string {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}, false, 1, "TAMPERED: line 2 (seq 3): expected seq 2"},
+		{"truncated", func(l []string) []string {
+			return l[:2]
+		}, false, 0, "OK: 2 entries"},
+		{"truncated with head", func(l []string) []string {
+			return l[:2]
+		}, true, 1, "TRUNCATED: no entry has hash"},
+	}
+	for _, c := range cases {
+		path, head := writeLog(t, 3)
+		if c.change != nil {
+			rewrite(t, path, c.change)
+		}
+		args := []string{path}
+		if c.head {
+			args = []string{"-head", head, path}
+		}
+		var stdout, stderr bytes.Buffer
+		if status := run(args, &stdout, &stderr); status != c.status {
+			t.Errorf("%s: exit %d, want %d (%s%s)", c.name, status, c.status, stdout.String(), stderr.String())
+		}
+		if !strings.HasPrefix(stdout.String(), c.output) {
+			t.Errorf("%s: printed %q, want %q", c.name, stdout.String(), c.output)
+		}
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if status := run(nil, &stdout, &stderr); status != 2 {
+		t.Errorf("no args: exit %d, want 2", status)
+	}
+	if status := run([]string{filepath.Join(t.TempDir(), "missing.log")}, &stdout, &stderr); status != 2 {
+		t.Errorf("missing file: exit %d, want 2", status)
+	}
+}
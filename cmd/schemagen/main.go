@@ -0,0 +1,54 @@
+// Command schemagen writes a JSON Schema document for every protocol message,
+// generated from the typed structs in models/messages.go.
+//
+//	go run ./cmd/schemagen -out schemas
+//
+// Inbound messages (client to server) land in <out>/inbound, outbound ones
+// in <out>/outbound, one <type>.json per message.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"saber-websocket/models"
+	"saber-websocket/schema"
+)
+
+func main() {
+	out := flag.String("out", "schemas", "directory to write the schemas to")
+	flag.Parse()
+
+	count := 0
+	for dir, docs := range map[string][]models.MessageDoc{
+		"inbound":  models.InboundMessages,
+		"outbound": models.OutboundMessages,
+	} {
+		path := filepath.Join(*out, dir)
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, "mkdir:", err)
+			os.Exit(1)
+		}
+		for _, doc := range docs {
+			var s map[string]interface{}
+			if doc.Whole {
+				s = schema.Document(doc.Type, doc.Description, doc.Data)
+			} else {
+				s = schema.Message(doc.Type, doc.Description, doc.Data)
+			}
+			data, err := json.MarshalIndent(s, "", "  ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, doc.Type+":", err)
+				os.Exit(1)
+			}
+			if err := os.WriteFile(filepath.Join(path, doc.Type+".json"), append(data, '\n'), 0o644); err != nil {
+				fmt.Fprintln(os.Stderr, "write:", err)
+				os.Exit(1)
+			}
+			count++
+		}
+	}
+	fmt.Printf("Wrote %d schemas to %s\n", count, *out)
+}
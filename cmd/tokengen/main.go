@@ -0,0 +1,75 @@
+// Command tokengen mints signed tokens for the WebSocket server.
+//
+//	TEACHER_TOKEN_SECRET=... go run ./cmd/tokengen -sub t-123 -email jdoe@school.org -classes P1,P3
+//	TEACHER_TOKEN_SECRET=... go run ./cmd/tokengen -sub ta-7 -staff co_teacher -classes P1
+//	STUDENT_TOKEN_SECRET=... go run ./cmd/tokengen -role student -sub ext-42 -email kid@school.org -classes P1
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"saber-websocket/auth"
+	"strings"
+	"time"
+)
+
+func main() {
+	role := flag.String("role", "teacher", "token type: teacher or student")
+	subject := flag.String("sub", "", "teacher identifier, or the student's extension clientId (required)")
+	email := flag.String("email", "", "email shown on the dashboard (must match student_connect for students)")
+	name := flag.String("name", "", "teacher display name")
+	staffRole := flag.String("staff", "owner", "teacher staff role: owner, co_teacher or observer")
+	classes := flag.String("classes", "", "comma separated class codes, or * for all (students: exactly one)")
+	ttl := flag.Duration("ttl", 12*time.Hour, "token lifetime")
+	flag.Parse()
+
+	if *subject == "" || *classes == "" {
+		fmt.Fprintln(os.Stderr, "-sub and -classes are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	var (
+		secret string
+		claims interface{}
+	)
+	switch *role {
+	case "teacher":
+		secret = os.Getenv("TEACHER_TOKEN_SECRET")
+		claims = auth.TeacherClaims{
+			Subject:   *subject,
+			Email:     *email,
+			Name:      *name,
+			Classes:   strings.Split(*classes, ","),
+			Role:      *staffRole,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(*ttl).Unix(),
+		}
+	case "student":
+		secret = os.Getenv("STUDENT_TOKEN_SECRET")
+		claims = auth.EnrollmentClaims{
+			ClientID:  *subject,
+			Email:     *email,
+			ClassCode: *classes,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(*ttl).Unix(),
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown -role:", *role)
+		os.Exit(2)
+	}
+
+	if secret == "" {
+		fmt.Fprintf(os.Stderr, "%s_TOKEN_SECRET is required\n", strings.ToUpper(*role))
+		os.Exit(2)
+	}
+
+	token, err := auth.Sign([]byte(secret), claims)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign:", err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
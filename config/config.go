@@ -1,8 +1,14 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,10 +21,133 @@ type Config struct {
 	PingInterval      time.Duration
 	// Increased buffer to handle burst traffic, but logic will drop packets if full
 	MessageBufferSize int 
+	// Class used when a client connects without a classCode (legacy extensions)
+	DefaultClassCode  string
+
+	// HMAC secret used to verify teacher_connect tokens
+	TeacherTokenSecret    string
+	// Development escape hatch: accept teacher_connect without a token
+	AllowInsecureTeachers bool
+
+	// When set, student_connect must carry a server-signed enrollment token
+	RequireEnrollmentTokens bool
+	StudentTokenSecret      string
+
+	// How long a dropped student's slot is held for a resume (0 disables)
+	ResumeGracePeriod time.Duration
+
+	// What to do when a second connection claims a live clientId
+	DuplicateClientPolicy string
+	// What to do when a second teacher connects to a class that has one
+	TeacherTakeoverPolicy string
+
+	// Backplane: link several instances behind a load balancer.
+	// Empty BackplaneListen runs as a single instance.
+	InstanceID      string
+	BackplaneListen string   // "host:port" or "unix:/path.sock"
+	BackplanePeers  []string // Every other instance's listen address
+	// Shared by every instance; peers that can't prove they hold it are
+	// dropped. Required unless BackplaneListen is a unix socket or loopback.
+	BackplaneSecret string
+
+	// Base delay suggested to clients in server_shutdown (jittered up to 2x)
+	ShutdownReconnectHint time.Duration
+	// How long shutdown waits for clients to be notified and flushed
+	ShutdownTimeout time.Duration
+
+	// Presence: a student is idle after IdleAfter without user activity and
+	// unresponsive after UnresponsiveAfter without any traffic at all. A
+	// quiet student is only heard from when it answers a ping, so
+	// UnresponsiveAfter must be longer than PingInterval.
+	PresenceInterval  time.Duration
+	IdleAfter         time.Duration
+	UnresponsiveAfter time.Duration
+
+	// How long a new socket has to send student_connect or teacher_connect
+	// before it is closed (0 waits forever)
+	IdentifyTimeout time.Duration
+
+	// Oldest protocol version accepted; raise above 1 to refuse extensions
+	// that connect without a hello
+	MinProtocolVersion int
+
+	// How long a command waits for the student's command_ack (and then for
+	// its command_result) before the dashboard is told it timed out
+	CommandTimeout time.Duration
+
+	// Upper bound on one outbound frame batching queued messages; a single
+	// larger message still goes out on its own
+	MaxBatchBytes int
+
+	// JSON file defining commands, their arguments, and who may send them
+	// where (see package policy). Without one any well-formed name is relayed.
+	CommandPolicyFile string
+	// Shorthand for a policy that only lists command names; can't be
+	// combined with CommandPolicyFile
+	AllowedCommands []string
+
+	// Origins each role may connect from (see handlers/origin.go); an empty
+	// list allows any origin
+	StudentOrigins []string
+	TeacherOrigins []string
+	// Whether clients that send no Origin (non-browser tools) are let in
+	// when a role has an allowlist
+	AllowMissingOrigin bool
+
+	// Token buckets applied to each connection (see handlers/ratelimit.go).
+	// RateMessages covers everything; the others add tighter limits for the
+	// chatty message types. A zero rate means unlimited.
+	RateMessages    RateLimit
+	RateScreenshots RateLimit // screenshot messages and binary frames
+	RateTabEvents   RateLimit // tabs_update and tab_created/updated/removed
+	RateCommands    RateLimit // teacher_command, teacher_broadcast, teacher_kick
+	// Messages over a limit are dropped. RateLimitWarnAfter drops within
+	// RateLimitWindow earn the client a rate_limited warning, and
+	// RateLimitCloseAfter close the connection (0 disables either).
+	RateLimitWindow     time.Duration
+	RateLimitWarnAfter  int
+	RateLimitCloseAfter int
+	// Cap for everything but screenshots, which get all of MaxMessageSize
+	MaxControlMessageSize int64
+
+	// Simultaneous connections allowed from one source address (0 is
+	// unlimited). Mind that a whole school may sit behind one NAT address.
+	MaxConnectionsPerIP int
+	// Proxies (IPs or CIDRs) whose X-Forwarded-For is believed when working
+	// out a connection's source address
+	TrustedProxies []*net.IPNet
+
+	// Append-only, hash-chained record of teacher actions (empty disables)
+	AuditLogFile string
+	// Bearer token for GET /audit; the endpoint is off without one
+	AuditToken string
+
+	// Settings LoadConfig had to correct, for main to report
+	warnings []string
 }
 
+// RateLimit is a token bucket: PerSecond tokens refill continuously, up to Burst
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Duplicate clientId policies
+const (
+	DuplicateReplace = "replace" // Close the old connection, keep the new one
+	DuplicateReject  = "reject"  // Refuse the new connection
+	DuplicateMulti   = "multi"   // Keep both, giving the new one a "#n" sub-ID
+)
+
+// Teacher takeover policies
+const (
+	TakeoverReplace = "takeover" // Newcomer becomes owner, old session is closed
+	TakeoverReject  = "reject"   // Newcomer is refused
+	TakeoverObserve = "observe"  // Newcomer is kept as a read-only observer
+)
+
 func LoadConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		Port:           getEnv("PORT", "8080"),
 		MaxStudents:    getEnvInt("MAX_STUDENTS", 100), // Increased default
 		MaxMessageSize: 10 * 1024 * 1024, // 10MB
@@ -26,6 +155,70 @@ func LoadConfig() *Config {
 		PongTimeout:    60 * time.Second,
 		PingInterval:   50 * time.Second,
 		MessageBufferSize: 128, 
+		DefaultClassCode:  getEnv("DEFAULT_CLASS_CODE", "default"),
+		TeacherTokenSecret:    getEnv("TEACHER_TOKEN_SECRET", ""),
+		AllowInsecureTeachers: getEnvBool("ALLOW_INSECURE_TEACHERS", false),
+		RequireEnrollmentTokens: getEnvBool("REQUIRE_ENROLLMENT_TOKENS", false),
+		StudentTokenSecret:      getEnv("STUDENT_TOKEN_SECRET", ""),
+		ResumeGracePeriod:       time.Duration(getEnvInt("RESUME_GRACE_SECONDS", 30)) * time.Second,
+		DuplicateClientPolicy:   getEnv("DUPLICATE_CLIENT_POLICY", DuplicateReplace),
+		TeacherTakeoverPolicy:   getEnv("TEACHER_TAKEOVER_POLICY", TakeoverReplace),
+		InstanceID:              getEnv("INSTANCE_ID", defaultInstanceID()),
+		BackplaneListen:         getEnv("BACKPLANE_LISTEN", ""),
+		BackplanePeers:          getEnvList("BACKPLANE_PEERS"),
+		BackplaneSecret:         getEnv("BACKPLANE_SECRET", ""),
+		ShutdownReconnectHint:   time.Duration(getEnvInt("SHUTDOWN_RECONNECT_HINT_MS", 2000)) * time.Millisecond,
+		ShutdownTimeout:         time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 10)) * time.Second,
+		PresenceInterval:        time.Duration(getEnvInt("PRESENCE_INTERVAL_SECONDS", 5)) * time.Second,
+		IdleAfter:               time.Duration(getEnvInt("IDLE_AFTER_SECONDS", 180)) * time.Second,
+		UnresponsiveAfter:       time.Duration(getEnvInt("UNRESPONSIVE_AFTER_SECONDS", 55)) * time.Second,
+		IdentifyTimeout:         time.Duration(getEnvInt("IDENTIFY_TIMEOUT_SECONDS", 10)) * time.Second,
+		MinProtocolVersion:      getEnvInt("MIN_PROTOCOL_VERSION", 1),
+		CommandTimeout:          time.Duration(getEnvInt("COMMAND_TIMEOUT_SECONDS", 10)) * time.Second,
+		MaxBatchBytes:           getEnvInt("MAX_BATCH_BYTES", 1024*1024),
+		CommandPolicyFile:       getEnv("COMMAND_POLICY_FILE", ""),
+		AllowedCommands:         getEnvList("ALLOWED_COMMANDS"),
+		StudentOrigins:          getEnvList("STUDENT_ALLOWED_ORIGINS"),
+		TeacherOrigins:          getEnvList("TEACHER_ALLOWED_ORIGINS"),
+		AllowMissingOrigin:      getEnvBool("ALLOW_MISSING_ORIGIN", true),
+		RateMessages:            getEnvRate("RATE_LIMIT_MESSAGES", RateLimit{PerSecond: 50, Burst: 200}),
+		RateScreenshots:         getEnvRate("RATE_LIMIT_SCREENSHOTS", RateLimit{PerSecond: 2, Burst: 10}),
+		RateTabEvents:           getEnvRate("RATE_LIMIT_TAB_EVENTS", RateLimit{PerSecond: 20, Burst: 100}),
+		RateCommands:            getEnvRate("RATE_LIMIT_COMMANDS", RateLimit{PerSecond: 5, Burst: 30}),
+		RateLimitWindow:         time.Duration(getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 10)) * time.Second,
+		RateLimitWarnAfter:      getEnvInt("RATE_LIMIT_WARN_AFTER", 20),
+		RateLimitCloseAfter:     getEnvInt("RATE_LIMIT_DISCONNECT_AFTER", 500),
+		MaxControlMessageSize:   int64(getEnvInt("MAX_CONTROL_MESSAGE_BYTES", 512*1024)),
+		MaxConnectionsPerIP:     getEnvInt("MAX_CONNECTIONS_PER_IP", 0),
+		TrustedProxies:          getEnvNets("TRUSTED_PROXIES"),
+		AuditLogFile:            getEnv("AUDIT_LOG_FILE", ""),
+		AuditToken:              getEnv("AUDIT_API_TOKEN", ""),
+	}
+	cfg.checkPresence()
+	return cfg
+}
+
+// Warnings lists the settings that were out of range and what was used instead
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// checkPresence keeps the presence sweep from panicking on a zero interval
+// and healthy students from flickering unresponsive between pings
+func (c *Config) checkPresence() {
+	if c.PresenceInterval <= 0 {
+		c.PresenceInterval = 5 * time.Second
+		c.warnings = append(c.warnings, "PRESENCE_INTERVAL_SECONDS must be positive; using 5")
+	}
+	if c.IdleAfter <= 0 {
+		c.IdleAfter = 180 * time.Second
+		c.warnings = append(c.warnings, "IDLE_AFTER_SECONDS must be positive; using 180")
+	}
+	if minimum := c.PingInterval + 5*time.Second; c.UnresponsiveAfter < minimum {
+		c.warnings = append(c.warnings, fmt.Sprintf(
+			"UNRESPONSIVE_AFTER_SECONDS must outlast the %s ping interval; using %d",
+			c.PingInterval, int(minimum.Seconds())))
+		c.UnresponsiveAfter = minimum
 	}
 }
 
@@ -43,4 +236,74 @@ func getEnvInt(key string, defaultValue int) int {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvRate reads "rate" or "rate:burst", e.g. "20:100"; the burst defaults
+// to one second's worth
+func getEnvRate(key string, defaultValue RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	rateStr, burstStr, hasBurst := strings.Cut(value, ":")
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+	if err != nil || rate < 0 {
+		return defaultValue
+	}
+	limit := RateLimit{PerSecond: rate, Burst: int(math.Ceil(rate))}
+	if hasBurst {
+		burst, err := strconv.Atoi(strings.TrimSpace(burstStr))
+		if err != nil || burst < 1 {
+			return defaultValue
+		}
+		limit.Burst = burst
+	}
+	return limit
+}
+
+// getEnvNets reads a list of IPs and CIDRs; a bare IP is a single-address net
+func getEnvNets(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range getEnvList(key) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+			continue
+		}
+		if _, n, err := net.ParseCIDR(item); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// defaultInstanceID is unique per process so restarts are seen as new peers
+func defaultInstanceID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 3)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saber-websocket/audit"
+	"saber-websocket/config"
+	"saber-websocket/server"
+	"saber-websocket/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit queries: GET /audit with the AUDIT_API_TOKEN as a bearer token.
+//
+//	teacher, student, class, event   exact matches; event must be a known one
+//	                                 (audit.Events). With class set, student
+//	                                 also matches the class's broadcasts.
+//	since, until                     RFC 3339 or unix seconds; until is exclusive
+//	limit                            newest N matches (default 500, at most 5000)
+//
+// Entries come back oldest first, with the log's current head so the caller
+// can note it down for later verification.
+
+const (
+	defaultAuditLimit = 500
+	maxAuditLimit     = 5000
+)
+
+type auditResponse struct {
+	Entries   []*audit.Entry `json:"entries"`
+	Truncated bool           `json:"truncated"`
+	HeadSeq   uint64         `json:"headSeq"`
+	HeadHash  string         `json:"headHash"`
+}
+
+func ServeAudit(hub *server.Hub, w http.ResponseWriter, r *http.Request, cfg *config.Config, logger *utils.Logger) {
+	auditLog := hub.AuditLog()
+	if auditLog == nil || cfg.AuditToken == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AuditToken)) != 1 {
+		logger.Warn(fmt.Sprintf("Rejected audit query from %s: bad token", clientIP(r, cfg)))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="audit"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seq, head := auditLog.Head()
+	entries, truncated, err := auditLog.Query(filter)
+	if err != nil {
+		logger.Error("Audit query failed: " + err.Error())
+		http.Error(w, "Audit log unreadable", http.StatusInternalServerError)
+		return
+	}
+	logger.Info(fmt.Sprintf("Audit query from %s: %s (%d entries)", clientIP(r, cfg), r.URL.RawQuery, len(entries)))
+
+	if entries == nil {
+		entries = []*audit.Entry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auditResponse{
+		Entries:   entries,
+		Truncated: truncated,
+		HeadSeq:   seq,
+		HeadHash:  head,
+	})
+}
+
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	filter := audit.Filter{
+		TeacherID: q.Get("teacher"),
+		StudentID: q.Get("student"),
+		ClassCode: q.Get("class"),
+		Event:     q.Get("event"),
+		Limit:     defaultAuditLimit,
+	}
+	if filter.Event != "" && !knownAuditEvent(filter.Event) {
+		return filter, fmt.Errorf("event: must be one of %s", strings.Join(audit.Events, ", "))
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(q.Get("since")); err != nil {
+		return filter, fmt.Errorf("since: %w", err)
+	}
+	if filter.Until, err = parseAuditTime(q.Get("until")); err != nil {
+		return filter, fmt.Errorf("until: %w", err)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return filter, fmt.Errorf("limit: must be a positive integer")
+		}
+		if limit > maxAuditLimit {
+			limit = maxAuditLimit
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func knownAuditEvent(event string) bool {
+	for _, e := range audit.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuditTime accepts RFC 3339 or unix seconds; empty is no bound
+func parseAuditTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 or unix seconds")
+	}
+	return t, nil
+}
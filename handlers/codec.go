@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"saber-websocket/models"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes messages on the wire for one connection. The hub itself
+// always works in JSON; connections on another codec are translated at the
+// edges (readPump on the way in, writePump on the way out), which is what
+// lets a CBOR dashboard watch JSON students and vice versa.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// WriteArray writes already-encoded messages as one encoded array
+	WriteArray(w io.Writer, items [][]byte) error
+}
+
+var errUnknownCodec = errors.New("unknown codec")
+
+// Codecs a client can ask for in hello
+var codecs = map[string]Codec{
+	models.CodecJSON:    jsonCodec{},
+	models.CodecMsgpack: msgpackCodec{},
+	models.CodecCBOR:    newCBORCodec(),
+}
+
+func codecFor(name string) (Codec, error) {
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, errUnknownCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return models.CodecJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) WriteArray(w io.Writer, items [][]byte) error {
+	sep := []byte{'['}
+	for _, item := range items {
+		w.Write(sep)
+		if _, err := w.Write(item); err != nil {
+			return err
+		}
+		sep[0] = ','
+	}
+	_, err := w.Write([]byte{']'})
+	return err
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                               { return models.CodecMsgpack }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+func (msgpackCodec) WriteArray(w io.Writer, items [][]byte) error {
+	var header []byte
+	switch n := len(items); {
+	case n < 16:
+		header = []byte{0x90 | byte(n)}
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16([]byte{0xdc}, uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint32([]byte{0xdd}, uint32(n))
+	}
+	return writeItems(w, header, items)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, _ := cbor.EncOptions{}.EncMode()
+	// Decode maps with string keys so translated messages re-encode as JSON
+	dec, _ := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string                                 { return models.CodecCBOR }
+func (c cborCodec) Marshal(v interface{}) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
+
+func (cborCodec) WriteArray(w io.Writer, items [][]byte) error {
+	var header []byte
+	switch n := len(items); {
+	case n < 24:
+		header = []byte{0x80 | byte(n)}
+	case n <= 0xff:
+		header = []byte{0x98, byte(n)}
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16([]byte{0x99}, uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint32([]byte{0x9a}, uint32(n))
+	}
+	return writeItems(w, header, items)
+}
+
+// writeItems writes an array header followed by the encoded items, which is
+// all an array is in both MessagePack and CBOR
+func writeItems(w io.Writer, header []byte, items [][]byte) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err := w.Write(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeToJSON translates an inbound codec frame into the JSON the handlers read
+func decodeToJSON(c Codec, data []byte) ([]byte, error) {
+	var v interface{}
+	if err := c.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s message is not a map", c.Name())
+	}
+	return json.Marshal(v)
+}
+
+// encodeFromJSON translates an outbound hub message into the client's codec.
+// Integers stay integers rather than becoming floats on the way through.
+func encodeFromJSON(c Codec, data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return c.Marshal(normalizeNumbers(v))
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = normalizeNumbers(item)
+		}
+	}
+	return v
+}
+
+// isJSONMessage reports whether an outbound message is hub JSON (as opposed
+// to a binary screenshot frame)
+func isJSONMessage(msg []byte) bool {
+	return len(msg) > 0 && (msg[0] == '{' || msg[0] == '[')
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"saber-websocket/config"
 	"saber-websocket/models"
@@ -15,15 +16,34 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	// Clients may pin a protocol version through Sec-WebSocket-Protocol
+	Subprotocols: subprotocols(),
+	// Only used once a client asks for the compression capability
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins - in production, restrict this
+		// Checked in ServeWs against the configured allowlists (origin.go)
 		return true
 	},
 }
 
 func ServeWs(hub *server.Hub, w http.ResponseWriter, r *http.Request, cfg *config.Config, logger *utils.Logger) {
+	origin := r.Header.Get("Origin")
+	if !checkUpgradeOrigin(origin, cfg) {
+		logger.Warn(fmt.Sprintf("Rejected WebSocket upgrade from %s: origin %q is not allowed", r.RemoteAddr, origin))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	ip := clientIP(r, cfg)
+	if !connections.acquire(ip, cfg.MaxConnectionsPerIP) {
+		logger.Warn(fmt.Sprintf("Rejected WebSocket upgrade from %s: already %d connections from that address",
+			ip, cfg.MaxConnectionsPerIP))
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		connections.release(ip)
 		logger.Error("WebSocket upgrade failed: " + err.Error())
 		return
 	}
@@ -31,72 +51,196 @@ func ServeWs(hub *server.Hub, w http.ResponseWriter, r *http.Request, cfg *confi
 	client := &models.Client{
 		Conn:        conn,
 		Send:        make(chan []byte, cfg.MessageBufferSize),
+		WriteDone:   make(chan struct{}),
+		Origin:      origin,
+		RemoteIP:    ip,
+		ConnectedAt: time.Now(),
 		LastSeen:    time.Now(),
-		CurrentTabs: make(map[string]interface{}),
+		CurrentTabs: make(map[string]json.RawMessage),
+	}
+	conn.EnableWriteCompression(false)
+	if v := models.ProtocolFromSubprotocol(conn.Subprotocol()); v != 0 {
+		client.SetProtocol(v, nil)
 	}
 
 	// Start read and write pumps
 	go writePump(client, cfg, logger)
 	go readPump(client, hub, cfg, logger)
+
+	// A socket that never says who it is doesn't get to hold a connection
+	if cfg.IdentifyTimeout > 0 {
+		time.AfterFunc(cfg.IdentifyTimeout, func() {
+			if client.ExpireUnidentified() {
+				logger.Warn(fmt.Sprintf("Closing connection from %s: not identified within %s",
+					describeSender(client), cfg.IdentifyTimeout))
+				sendError(client, ErrCodeIdentifyTimeout, "Send student_connect or teacher_connect first")
+				client.CloseWith(models.CloseIdentifyTimeout, "identify_timeout")
+			}
+		})
+	}
+}
+
+// checkUnidentified refuses a connect message on a connection that already
+// has a role; switching roles takes a new connection
+func checkUnidentified(client *models.Client, role string, logger *utils.Logger) bool {
+	switch client.State() {
+	case models.StateUpgraded:
+		return true
+	case models.StateClosing:
+		return false
+	}
+	current := client.GetClientType()
+	if current != role {
+		logger.Warn(fmt.Sprintf("Rejected %s connect from %s %s: can't switch roles", role, current, describeSender(client)))
+		sendError(client, ErrCodeProtocol, "Already connected as "+current+"; open a new connection to connect as "+role)
+		return false
+	}
+	sendError(client, ErrCodeProtocol, "Already connected")
+	return false
 }
 
 func readPump(client *models.Client, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
 	defer func() {
 		hub.Unregister(client)
+		client.Close() // Unidentified clients have no room to do it
 		client.Conn.Close()
+		connections.release(client.RemoteIP)
 	}()
 
-	client.Conn.SetReadLimit(cfg.MaxMessageSize)
 	client.Conn.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
 	client.Conn.SetPongHandler(func(string) error {
+		// A pong is often all a quiet student sends; it counts for presence
+		client.UpdateLastSeen()
 		client.Conn.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
 		return nil
 	})
 
+	limiter := newRateLimiter(cfg)
+	var limit int64
 	for {
-		_, messageBytes, err := client.Conn.ReadMessage()
+		// Raised for students once they identify (see readLimit)
+		if l := readLimit(client, cfg); l != limit {
+			limit = l
+			client.Conn.SetReadLimit(limit)
+		}
+		messageType, messageBytes, err := client.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if err == websocket.ErrReadLimit {
+				logger.Warn(fmt.Sprintf("Closing %s: sent a message over the %d byte limit", describeSender(client), limit))
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Warn("Unexpected close: " + err.Error())
 			}
 			break
 		}
 
 		client.UpdateLastSeen()
+		size := len(messageBytes)
+		if !limiter.admitFrame(client, logger) {
+			continue
+		}
+
+		if messageType == websocket.BinaryMessage {
+			if models.IsBinaryFrame(messageBytes) {
+				if limiter.admit(client, "screenshot", size, logger) {
+					HandleScreenshotFrame(client, messageBytes, hub, logger)
+				}
+				continue
+			}
+			// Anything else binary is a message in the negotiated codec
+			codec, _ := codecFor(client.Codec())
+			if codec.Name() == models.CodecJSON {
+				sendError(client, ErrCodeProtocol, "Binary messages require a negotiated codec")
+				continue
+			}
+			if messageBytes, err = decodeToJSON(codec, messageBytes); err != nil {
+				logger.Warn("Invalid " + codec.Name() + " message: " + err.Error())
+				continue
+			}
+		}
 
-		var msg models.Message
-		if err := json.Unmarshal(messageBytes, &msg); err != nil {
+		// Only the envelope is decoded here; each handler's data is decoded
+		// and validated on its own, and relay payloads stay raw
+		var raw models.RawMessage
+		if err := json.Unmarshal(messageBytes, &raw); err != nil {
 			logger.Warn("Invalid JSON message: " + err.Error())
 			continue
 		}
+		if !limiter.admit(client, raw.Type, size, logger) {
+			continue
+		}
+		if routeRelay(client, raw, hub, cfg, logger) {
+			continue
+		}
 
 		// Route message based on type
-		switch msg.Type {
+		switch raw.Type {
+		case "hello":
+			var msg models.Hello
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleHello(client, &msg, hub, cfg, logger)
+			}
 		case "student_connect":
-			HandleStudentConnect(client, msg, hub, logger)
-		case "tabs_update", "tab_created", "tab_updated", "tab_removed":
-			HandleTabUpdate(client, msg, hub, logger)
-		case "screenshot":
-			HandleScreenshot(client, msg, hub, cfg, logger)
-		case "screenshot_error", "screenshot_skipped":
-			HandleScreenshotError(client, msg, hub, logger)
+			var msg models.StudentConnect
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleStudentConnect(client, &msg, hub, cfg, logger)
+			}
 		case "ping":
-			HandlePing(client, msg, hub, logger)
+			HandlePing(client, hub, logger)
+		case "activity":
+			var msg models.Activity
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleActivity(client, &msg, hub, logger)
+			}
+		case "command_ack":
+			var msg models.CommandAck
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleCommandAck(client, &msg, hub, logger)
+			}
+		case "command_result":
+			var msg models.CommandResult
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleCommandResult(client, &msg, hub, logger)
+			}
 		case "teacher_connect":
-			HandleTeacherConnect(client, msg, hub, logger)
+			var msg models.TeacherConnect
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleTeacherConnect(client, &msg, hub, cfg, logger)
+			}
 		case "teacher_command":
-			HandleTeacherCommand(client, msg, hub, logger)
+			var msg models.TeacherCommand
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleTeacherCommand(client, &msg, hub, logger)
+			}
+		case "teacher_broadcast":
+			var msg models.TeacherBroadcast
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleTeacherBroadcast(client, &msg, hub, logger)
+			}
+		case "teacher_kick":
+			var msg models.TeacherKick
+			if decodeMessage(client, raw, &msg, logger) {
+				HandleTeacherKick(client, &msg, hub, logger)
+			}
 		default:
-			logger.Warn("Unknown message type: " + msg.Type)
+			logger.Warn("Unknown message type: " + raw.Type)
+			// Negotiated clients expect to hear about it; legacy ones never did
+			if client.ProtocolVersion() > models.ProtocolLegacy {
+				sendError(client, ErrCodeUnsupportedType, "Unknown message type: "+raw.Type)
+			}
 		}
 	}
 }
 
 func writePump(client *models.Client, cfg *config.Config, logger *utils.Logger) {
 	ticker := time.NewTicker(cfg.PingInterval)
+	compressing := false
+	closing := false
 	defer func() {
 		ticker.Stop()
-		client.Conn.Close()
+		if !closing {
+			client.Conn.Close()
+		}
+		close(client.WriteDone)
 	}()
 
 	for {
@@ -105,24 +249,28 @@ func writePump(client *models.Client, cfg *config.Config, logger *utils.Logger)
 			client.Conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
 			if !ok {
 				// Hub closed the channel
-				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := client.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+				closeMsg := []byte{}
+				if code, reason := client.CloseInfo(); code != 0 {
+					closeMsg = websocket.FormatCloseMessage(code, reason)
+				}
+				client.Conn.WriteMessage(websocket.CloseMessage, closeMsg)
+				// Leave the conn to readPump for a moment so it keeps draining
+				// until the peer answers. Closing with unread data in the
+				// buffer sends a reset, and a client that's flooding us would
+				// lose the close frame (and its code) with it.
+				client.Conn.SetReadDeadline(time.Now().Add(cfg.WriteTimeout))
+				closing = true
 				return
 			}
-			w.Write(message)
 
-			// Add queued messages to current write
-			n := len(client.Send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-client.Send)
+			// Compression is opt-in through hello; toggled here since only
+			// the write side may touch the conn's write settings
+			if want := client.HasCapability(models.CapCompression); want != compressing {
+				client.Conn.EnableWriteCompression(want)
+				compressing = want
 			}
 
-			if err := w.Close(); err != nil {
+			if err := writeQueued(client, message, cfg); err != nil {
 				return
 			}
 
@@ -134,3 +282,69 @@ func writePump(client *models.Client, cfg *config.Config, logger *utils.Logger)
 		}
 	}
 }
+
+// routeRelay handles the student_* relay stream, which passes payloads
+// through to staff untouched once they validate. Returns false for any other
+// message type.
+func routeRelay(client *models.Client, raw models.RawMessage, hub *server.Hub, cfg *config.Config, logger *utils.Logger) bool {
+	switch raw.Type {
+	case "tabs_update":
+		var msg models.TabsUpdate
+		if decodeRelay(client, raw, &msg, logger) {
+			HandleTabUpdate(client, raw, msg.Tabs, hub, logger)
+		}
+	case "tab_created", "tab_updated", "tab_removed":
+		if decodeRelay(client, raw, &models.TabEvent{}, logger) {
+			HandleTabUpdate(client, raw, nil, hub, logger)
+		}
+	case "screenshot":
+		if decodeRelay(client, raw, &models.Screenshot{}, logger) {
+			HandleScreenshot(client, raw, hub, cfg, logger)
+		}
+	case "screenshot_error", "screenshot_skipped":
+		if decodeRelay(client, raw, &models.ScreenshotError{}, logger) {
+			HandleScreenshotError(client, raw, hub, logger)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// classCodeOrDefault falls back to the configured class for extensions that
+// predate classes. The code's format was checked with the rest of the message.
+func classCodeOrDefault(code string, cfg *config.Config) string {
+	if code == "" {
+		return cfg.DefaultClassCode
+	}
+	return code
+}
+
+// Machine-readable error codes sent alongside the human message
+const (
+	ErrCodeInvalidClass = "invalid_class_code"
+	ErrCodeAuthRequired = "auth_required"
+	ErrCodeAuthFailed   = "auth_failed"
+	ErrCodeForbidden    = "forbidden"
+
+	ErrCodeProtocol           = "protocol_error"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnsupportedType    = "unsupported_type"
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeIdentifyTimeout    = "identify_timeout"
+	ErrCodeCommandDenied      = "command_denied"
+)
+
+// sendError replies directly to a client that has not (yet) been registered
+func sendError(client *models.Client, code, errorMsg string) {
+	sendErrorData(client, code, errorMsg, nil)
+}
+
+// sendErrorData is sendError with details for the client to act on
+func sendErrorData(client *models.Client, code, errorMsg string, data interface{}) {
+	msg := models.ErrorReply{Type: "error", Code: code, Message: errorMsg, Data: data}
+	if data, err := json.Marshal(msg); err == nil {
+		client.TrySend(data)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"saber-websocket/config"
+	"saber-websocket/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// wireMessage is one queued message in the connection's encoding
+type wireMessage struct {
+	data   []byte
+	binary bool // Codec message or screenshot frame rather than JSON text
+	frame  bool // Screenshot frame: only length-prefixed batches may carry it
+}
+
+// writeQueued writes message plus whatever else is already queued, packed
+// into frames according to the connection's framing mode and capped at
+// MaxBatchBytes per frame.
+func writeQueued(client *models.Client, message []byte, cfg *config.Config) error {
+	codec, _ := codecFor(client.Codec())
+
+	queued := make([]wireMessage, 0, 1+len(client.Send))
+	n := len(client.Send)
+	for i := 0; ; i++ {
+		if msg, ok := encodeOutbound(codec, message); ok {
+			queued = append(queued, msg)
+		}
+		if i == n {
+			break
+		}
+		// Add queued messages to current write
+		var ok bool
+		if message, ok = <-client.Send; !ok {
+			break
+		}
+	}
+
+	framing := client.Framing()
+	for len(queued) > 0 {
+		size := batchSize(queued, framing, cfg.MaxBatchBytes)
+		if err := writeBatch(client.Conn, queued[:size], framing, codec); err != nil {
+			return err
+		}
+		queued = queued[size:]
+	}
+	return nil
+}
+
+// encodeOutbound translates a hub message into the client's codec
+func encodeOutbound(codec Codec, message []byte) (wireMessage, bool) {
+	if models.IsBinaryFrame(message) {
+		return wireMessage{data: message, binary: true, frame: true}, true
+	}
+	if codec.Name() == models.CodecJSON || !isJSONMessage(message) {
+		return wireMessage{data: message}, true
+	}
+	encoded, err := encodeFromJSON(codec, message)
+	if err != nil {
+		return wireMessage{}, false
+	}
+	return wireMessage{data: encoded, binary: true}, true
+}
+
+// batchSize returns how many leading messages share the next frame
+func batchSize(queued []wireMessage, framing string, maxBytes int) int {
+	bytes := len(queued[0].data)
+	size := 1
+	for size < len(queued) && batchable(queued[0], framing) {
+		next := queued[size]
+		if !batchable(next, framing) || bytes+len(next.data) > maxBytes {
+			break
+		}
+		bytes += len(next.data)
+		size++
+	}
+	return size
+}
+
+// batchable reports whether a message may share a frame with others
+func batchable(msg wireMessage, framing string) bool {
+	switch framing {
+	case models.FramingLengthPrefixed:
+		return true
+	case models.FramingArray:
+		return !msg.frame
+	default:
+		// Newline joining only ever worked for JSON text
+		return !msg.binary
+	}
+}
+
+// writeBatch streams one frame. A lone message goes out as itself.
+func writeBatch(conn *websocket.Conn, batch []wireMessage, framing string, codec Codec) error {
+	if len(batch) == 1 {
+		messageType := websocket.TextMessage
+		if batch[0].binary {
+			messageType = websocket.BinaryMessage
+		}
+		return conn.WriteMessage(messageType, batch[0].data)
+	}
+
+	messageType := websocket.BinaryMessage
+	if framing == models.FramingNewline || (framing == models.FramingArray && codec.Name() == models.CodecJSON) {
+		messageType = websocket.TextMessage
+	}
+	w, err := conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+
+	switch framing {
+	case models.FramingLengthPrefixed:
+		w.Write([]byte{models.FrameMagic[0], models.FrameMagic[1], models.FrameBatch})
+		for _, msg := range batch {
+			w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg.data))))
+			w.Write(msg.data)
+		}
+	case models.FramingArray:
+		items := make([][]byte, len(batch))
+		for i, msg := range batch {
+			items[i] = msg.data
+		}
+		codec.WriteArray(w, items)
+	default:
+		for i, msg := range batch {
+			if i > 0 {
+				w.Write([]byte{'\n'})
+			}
+			w.Write(msg.data)
+		}
+	}
+	return w.Close()
+}
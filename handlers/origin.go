@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"saber-websocket/utils"
+	"strings"
+)
+
+// Origin checks. Browsers send the page's Origin with every WebSocket
+// upgrade and scripts can't forge it, so the allowlists stop arbitrary
+// websites a student visits from opening a socket and posing as the
+// dashboard. Each role has its own list:
+//
+//	https://dash.school.org       exact origin (scheme, host and port)
+//	https://*.school.org          any subdomain of school.org, over https
+//	chrome-extension://<id>       one extension
+//	*                             anything
+//
+// An empty list leaves that role open. Upgrades are checked against the
+// union of both lists, since the role is only known once the client sends
+// its connect message; the role's own list is checked again then.
+
+// checkUpgradeOrigin decides whether an upgrade may proceed at all
+func checkUpgradeOrigin(origin string, cfg *config.Config) bool {
+	return originAllowed(origin, cfg.StudentOrigins, cfg) || originAllowed(origin, cfg.TeacherOrigins, cfg)
+}
+
+// checkRoleOrigin refuses a connect message from an origin the role's
+// allowlist doesn't cover, closing the connection
+func checkRoleOrigin(client *models.Client, role string, cfg *config.Config, logger *utils.Logger) bool {
+	patterns := cfg.StudentOrigins
+	if role == "teacher" {
+		patterns = cfg.TeacherOrigins
+	}
+	if originAllowed(client.Origin, patterns, cfg) {
+		return true
+	}
+	logger.Warn(fmt.Sprintf("Rejected %s connect from %s: origin %q is not allowed",
+		role, client.Conn.RemoteAddr(), client.Origin))
+	sendError(client, ErrCodeForbidden, "Origin not allowed for "+role+"s")
+	client.CloseWith(models.CloseOriginRejected, "origin_not_allowed")
+	return false
+}
+
+// originAllowed matches an Origin header against one role's allowlist
+func originAllowed(origin string, patterns []string, cfg *config.Config) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	// Only browsers send Origin, and they always do; anything without one
+	// isn't a page that could be abused cross-site
+	if origin == "" {
+		return cfg.AllowMissingOrigin
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		if matchOrigin(origin, strings.ToLower(strings.TrimSuffix(pattern, "/"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(origin, pattern string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != scheme {
+		return false
+	}
+	// Subdomains only: "*.school.org" doesn't match school.org itself
+	return strings.HasSuffix(u.Host, "."+host) && len(u.Host) > len(host)+1
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"saber-websocket/config"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	cases := []struct {
+		origin, pattern string
+		want            bool
+	}{
+		{"https://dash.example.com", "https://dash.example.com", true},
+		{"https://dash.example.com", "*", true},
+		{"chrome-extension://abcdefghijklmnop", "chrome-extension://abcdefghijklmnop", true},
+		{"chrome-extension://otherextension", "chrome-extension://abcdefghijklmnop", false},
+
+		// Scheme mismatch
+		{"http://dash.example.com", "https://dash.example.com", false},
+		{"http://a.example.com", "https://*.example.com", false},
+		{"wss://a.example.com", "https://*.example.com", false},
+
+		// Port mismatch
+		{"https://dash.example.com:8443", "https://dash.example.com", false},
+		{"https://dash.example.com", "https://dash.example.com:8443", false},
+		{"https://a.example.com:8443", "https://*.example.com", false},
+		{"https://a.example.com:8443", "https://*.example.com:8443", true},
+		{"https://a.example.com:9443", "https://*.example.com:8443", false},
+
+		// Wildcards match subdomains on a label boundary only
+		{"https://a.example.com", "https://*.example.com", true},
+		{"https://a.b.example.com", "https://*.example.com", true},
+		{"https://example.com", "https://*.example.com", false},
+		{"https://evilexample.com", "https://*.example.com", false},
+		{"https://a.evilexample.com", "https://*.example.com", false},
+		{"https://.example.com", "https://*.example.com", false},
+		{"https://example.com.evil.org", "https://*.example.com", false},
+		{"https://a.example.com.evil.org", "https://*.example.com", false},
+
+		{"null", "https://*.example.com", false},
+	}
+	for _, c := range cases {
+		if got := matchOrigin(c.origin, c.pattern); got != c.want {
+			t.Errorf("matchOrigin(%q, %q) = %v, want %v", c.origin, c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	patterns := []string{"https://*.Example.com/", "chrome-extension://abcdefghijklmnop"}
+	cfg := &config.Config{}
+
+	cases := []struct {
+		origin       string
+		patterns     []string
+		allowMissing bool
+		want         bool
+	}{
+		{"https://dash.example.com", patterns, false, true},
+		{"HTTPS://Dash.Example.COM", patterns, false, true},
+		{"https://evilexample.com", patterns, false, false},
+		{"chrome-extension://abcdefghijklmnop", patterns, false, true},
+
+		// Missing Origin header: refused unless explicitly allowed
+		{"", patterns, false, false},
+		{"", patterns, true, true},
+
+		// No list leaves the role open
+		{"https://evilexample.com", nil, false, true},
+		{"", nil, false, true},
+	}
+	for _, c := range cases {
+		cfg.AllowMissingOrigin = c.allowMissing
+		if got := originAllowed(c.origin, c.patterns, cfg); got != c.want {
+			t.Errorf("originAllowed(%q, %q, allowMissing=%v) = %v, want %v",
+				c.origin, c.patterns, c.allowMissing, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"saber-websocket/server"
+	"saber-websocket/utils"
+)
+
+// Capabilities this server can turn on for a connection
+var serverCapabilities = []string{
+	models.CapCompression,
+	models.CapBinary,
+	models.CapAcks,
+	models.CapSeq,
+}
+
+// Subprotocols offered in the upgrade, most preferred first
+func subprotocols() []string {
+	names := []string{}
+	for v := models.MaxProtocol; v >= models.MinProtocol; v-- {
+		names = append(names, models.Subprotocol(v))
+	}
+	return names
+}
+
+// HandleHello agrees on a protocol version and capability set. It must come
+// before student_connect/teacher_connect. A version pinned through
+// Sec-WebSocket-Protocol at upgrade time has to be among the offered ones.
+func HandleHello(client *models.Client, msg *models.Hello, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
+	if client.State() != models.StateUpgraded || client.Negotiated() {
+		sendError(client, ErrCodeProtocol, "hello must be sent once, before connecting")
+		return
+	}
+
+	offered := helloVersions(msg)
+	version := 0
+	for _, v := range offered {
+		if v < cfg.MinProtocolVersion || v > models.MaxProtocol || v <= version {
+			continue
+		}
+		if pinned := models.ProtocolFromSubprotocol(client.Conn.Subprotocol()); pinned != 0 && v != pinned {
+			continue
+		}
+		version = v
+	}
+	if version == 0 {
+		refuseProtocol(client, offered, cfg, logger)
+		return
+	}
+
+	requested := map[string]bool{}
+	for _, name := range msg.Capabilities {
+		requested[name] = true
+	}
+	caps := make([]string, 0, len(serverCapabilities))
+	for _, name := range serverCapabilities {
+		if requested[name] {
+			caps = append(caps, name)
+		}
+	}
+	client.SetProtocol(version, caps)
+
+	// Unknown codecs downgrade to JSON. The ack may already go out in the
+	// new codec, so clients ask for one codec and decode binary frames with it.
+	codec := models.CodecJSON
+	if msg.Codec != "" {
+		if c, err := codecFor(msg.Codec); err == nil {
+			codec = c.Name()
+		}
+	}
+	client.SetCodec(codec)
+
+	framing := models.FramingNewline
+	switch msg.Framing {
+	case models.FramingArray, models.FramingLengthPrefixed:
+		framing = msg.Framing
+	}
+	client.SetFraming(framing)
+
+	reply, _ := json.Marshal(models.Envelope{
+		Type: "hello_ack",
+		Data: models.HelloAck{
+			Version:      version,
+			Capabilities: caps,
+			Codec:        codec,
+			Framing:      framing,
+			MinVersion:   cfg.MinProtocolVersion,
+			MaxVersion:   models.MaxProtocol,
+		},
+	})
+	client.TrySend(reply)
+}
+
+// helloVersions reads the offered versions: either "versions": [1, 2] or a
+// single "version": 2
+func helloVersions(msg *models.Hello) []int {
+	versions := append([]int{}, msg.Versions...)
+	if msg.Version != 0 {
+		versions = append(versions, msg.Version)
+	}
+	return versions
+}
+
+// checkProtocol refuses connect messages from clients that skipped hello when
+// the server no longer speaks the legacy protocol
+func checkProtocol(client *models.Client, cfg *config.Config, logger *utils.Logger) bool {
+	if client.ProtocolVersion() >= cfg.MinProtocolVersion {
+		return true
+	}
+	refuseProtocol(client, []int{client.ProtocolVersion()}, cfg, logger)
+	return false
+}
+
+// refuseProtocol tells the client which versions we speak and closes it
+func refuseProtocol(client *models.Client, offered []int, cfg *config.Config, logger *utils.Logger) {
+	logger.Warn(fmt.Sprintf("Refused protocol versions %v from %s (server speaks %d-%d)",
+		offered, client.Conn.RemoteAddr(), cfg.MinProtocolVersion, models.MaxProtocol))
+	sendErrorData(client, ErrCodeUnsupportedVersion,
+		fmt.Sprintf("Unsupported protocol version; server speaks %d-%d", cfg.MinProtocolVersion, models.MaxProtocol),
+		models.VersionRange{MinVersion: cfg.MinProtocolVersion, MaxVersion: models.MaxProtocol})
+	client.CloseWith(models.CloseUnsupportedProtocol, "unsupported_protocol")
+}
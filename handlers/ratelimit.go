@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"saber-websocket/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flood protection. Every connection gets token buckets for its messages
+// overall plus tighter ones for screenshots, tab events and commands, and
+// a size cap for anything that isn't a screenshot. The overall bucket is
+// charged as soon as a frame is read, before any of it is decoded; the rest
+// once the message type is known. Messages over a limit are dropped without
+// a reply; a client that keeps at it is warned with a rate_limited error and
+// eventually disconnected with CloseRateLimited. Connections per source
+// address are capped separately, at upgrade time.
+
+// Names of the limits, as reported in RateLimitDetail
+const (
+	limitMessages    = "messages"
+	limitScreenshots = "screenshots"
+	limitTabEvents   = "tab_events"
+	limitCommands    = "commands"
+	limitSize        = "size"
+)
+
+// limitFor names the type-specific bucket a message draws from, if any
+func limitFor(msgType string) string {
+	switch msgType {
+	case "screenshot", "screenshot_error", "screenshot_skipped":
+		return limitScreenshots
+	case "tabs_update", "tab_created", "tab_updated", "tab_removed":
+		return limitTabEvents
+	case "teacher_command", "teacher_broadcast", "teacher_kick":
+		return limitCommands
+	}
+	return ""
+}
+
+// tokenBucket is only touched by its connection's readPump, so it has no lock
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil for an unlimited rate; a nil bucket allows everything
+func newTokenBucket(limit config.RateLimit) *tokenBucket {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: limit.PerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter holds one connection's buckets and its drop count for the
+// current window
+type rateLimiter struct {
+	cfg     *config.Config
+	all     *tokenBucket
+	buckets map[string]*tokenBucket
+	rates   map[string]config.RateLimit
+
+	windowStart time.Time
+	dropped     int
+	warned      bool
+	closed      bool
+}
+
+func newRateLimiter(cfg *config.Config) *rateLimiter {
+	rates := map[string]config.RateLimit{
+		limitMessages:    cfg.RateMessages,
+		limitScreenshots: cfg.RateScreenshots,
+		limitTabEvents:   cfg.RateTabEvents,
+		limitCommands:    cfg.RateCommands,
+	}
+	l := &rateLimiter{
+		cfg:         cfg,
+		all:         newTokenBucket(cfg.RateMessages),
+		buckets:     make(map[string]*tokenBucket),
+		rates:       rates,
+		windowStart: time.Now(),
+	}
+	for name, rate := range rates {
+		if name != limitMessages {
+			l.buckets[name] = newTokenBucket(rate)
+		}
+	}
+	return l
+}
+
+// admitFrame charges a frame against the overall message rate before it is
+// decoded, so a flood costs no more than the read. Refused frames are
+// dropped by the caller; repeat offenders are warned and then disconnected.
+func (l *rateLimiter) admitFrame(client *models.Client, logger *utils.Logger) bool {
+	if l.closed {
+		return false // Already on its way out; don't bother handling the rest
+	}
+	now := time.Now()
+	if l.all.allow(now) {
+		return true
+	}
+	l.strike(client, "message", limitMessages, now, logger)
+	return false
+}
+
+// admit applies the size cap and type-specific limits to a frame that
+// admitFrame let through, once its type is known
+func (l *rateLimiter) admit(client *models.Client, msgType string, size int, logger *utils.Logger) bool {
+	if l.closed {
+		return false
+	}
+	now := time.Now()
+	limit := limitFor(msgType)
+
+	broken := ""
+	switch {
+	case limit != limitScreenshots && l.cfg.MaxControlMessageSize > 0 && int64(size) > l.cfg.MaxControlMessageSize:
+		broken = limitSize
+	case limit != "" && !l.buckets[limit].allow(now):
+		broken = limit
+	default:
+		return true
+	}
+	l.strike(client, msgType, broken, now, logger)
+	return false
+}
+
+// readLimit is the largest frame a client may send. Only screenshots may
+// use all of MaxMessageSize, so only students get it, once they have
+// identified; everyone else is held to MaxControlMessageSize by the socket
+// itself and never gets to send the server a bigger frame to read.
+func readLimit(client *models.Client, cfg *config.Config) int64 {
+	if cfg.MaxControlMessageSize <= 0 || cfg.MaxControlMessageSize >= cfg.MaxMessageSize ||
+		client.GetClientType() == "student" {
+		return cfg.MaxMessageSize
+	}
+	return cfg.MaxControlMessageSize
+}
+
+// strike records a dropped message and escalates once there are enough of them
+func (l *rateLimiter) strike(client *models.Client, msgType, limit string, now time.Time, logger *utils.Logger) {
+	if now.Sub(l.windowStart) > l.cfg.RateLimitWindow {
+		l.windowStart, l.dropped, l.warned = now, 0, false
+	}
+	l.dropped++
+	if l.dropped == 1 {
+		logger.Debug(fmt.Sprintf("Dropping %s from %s: over the %s limit", msgType, describeSender(client), limit))
+	}
+
+	switch {
+	case l.cfg.RateLimitCloseAfter > 0 && l.dropped >= l.cfg.RateLimitCloseAfter:
+		l.closed = true
+		logger.Warn(fmt.Sprintf("Disconnecting %s: %d messages over the rate limits in %s (last: %s, %s limit)",
+			describeSender(client), l.dropped, now.Sub(l.windowStart).Round(time.Millisecond), msgType, limit))
+		client.CloseWith(models.CloseRateLimited, "rate_limited")
+
+	case l.cfg.RateLimitWarnAfter > 0 && l.dropped >= l.cfg.RateLimitWarnAfter && !l.warned:
+		l.warned = true
+		logger.Warn(fmt.Sprintf("Rate limiting %s: %d messages dropped (last: %s, %s limit)",
+			describeSender(client), l.dropped, msgType, limit))
+		sendErrorData(client, ErrCodeRateLimited, "Too many messages; some were dropped", models.RateLimitDetail{
+			MessageType: msgType,
+			Limit:       limit,
+			PerSecond:   l.rates[limit].PerSecond,
+			Dropped:     l.dropped,
+		})
+	}
+}
+
+// connectionCounter tracks open connections per source address
+type connectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var connections = &connectionCounter{counts: make(map[string]int)}
+
+// acquire counts a new connection from ip, refusing it once max are open
+// (max 0 is unlimited). Every successful acquire needs a release.
+func (c *connectionCounter) acquire(ip string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.counts[ip] >= max {
+		return false
+	}
+	c.counts[ip]++
+	return true
+}
+
+func (c *connectionCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+		return
+	}
+	c.counts[ip]--
+}
+
+// clientIP works out where a request really came from. X-Forwarded-For is
+// only believed when the direct peer is a trusted proxy, and then read from
+// the right: the first address our own proxies didn't add is the client.
+// Anything to the left of it could have been made up by the client.
+func clientIP(r *http.Request, cfg *config.Config) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(net.ParseIP(host), cfg) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break // Garbage; stop at the last address we could make sense of
+		}
+		host = ip.String()
+		if !trustedProxy(ip, cfg) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(ip net.IP, cfg *config.Config) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"saber-websocket/config"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cfg := &config.Config{}
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		cfg.TrustedProxies = append(cfg.TrustedProxies, n)
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+
+		// Only a trusted proxy's header is believed
+		{"untrusted proxy", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy, no header", "10.0.0.2:5000", nil, "10.0.0.2"},
+
+		// Walk back through trusted hops to the first untrusted one
+		{"multiple hops", "10.0.0.2:5000", []string{"198.51.100.1, 10.1.1.1, 10.2.2.2"}, "198.51.100.1"},
+		{"hops across headers", "10.0.0.2:5000", []string{"198.51.100.1", "10.1.1.1"}, "198.51.100.1"},
+		{"only trusted hops", "10.0.0.2:5000", []string{"10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+
+		// The client can prepend anything; only what our proxies appended counts
+		{"spoofed leading entries", "10.0.0.2:5000", []string{"1.2.3.4, 5.6.7.8, 198.51.100.1"}, "198.51.100.1"},
+		{"spoofed trusted address", "10.0.0.2:5000", []string{"10.9.9.9, 198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		{"garbage entry", "10.0.0.2:5000", []string{"1.2.3.4, not-an-ip, 10.1.1.1"}, "10.1.1.1"},
+		{"empty entries", "10.0.0.2:5000", []string{" , 198.51.100.1 ,"}, "198.51.100.1"},
+
+		// IPv6
+		{"ipv6 direct", "[2001:db8::7]:5000", nil, "2001:db8::7"},
+		{"ipv6 untrusted proxy", "[2001:db8::7]:5000", []string{"2001:db8::1"}, "2001:db8::7"},
+		{"ipv6 trusted proxy", "[fd00::2]:5000", []string{"2001:db8::1, fd00::3"}, "2001:db8::1"},
+		{"ipv6 normalised", "[fd00::2]:5000", []string{"2001:DB8:0:0:0:0:0:1"}, "2001:db8::1"},
+		{"ipv4 client behind ipv6 proxy", "[fd00::2]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, c := range cases {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: http.Header{}}
+		for _, v := range c.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r, cfg); got != c.want {
+			t.Errorf("%s: clientIP = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// relayEnvelope wraps an already-encoded student payload as
+//
+//	{"type":<msgType>,"data":{"clientId":<clientID>,"payload":<payload>}}
+//
+// by splicing bytes, so the payload is copied once and never re-encoded.
+// A missing payload relays as null, as it did when payloads were decoded.
+func relayEnvelope(msgType, clientID string, payload json.RawMessage) []byte {
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+	typeJSON, _ := json.Marshal(msgType)
+	idJSON, _ := json.Marshal(clientID)
+
+	var buf bytes.Buffer
+	buf.Grow(len(payload) + len(typeJSON) + len(idJSON) + 48)
+	buf.WriteString(`{"type":`)
+	buf.Write(typeJSON)
+	buf.WriteString(`,"data":{"clientId":`)
+	buf.Write(idJSON)
+	buf.WriteString(`,"payload":`)
+	buf.Write(payload)
+	buf.WriteString(`}}`)
+	return buf.Bytes()
+}
+
+// isJSONObject reports whether raw data is absent or a JSON object, which
+// is what the decoded map form used to accept. The envelope was already
+// validated by json.Unmarshal, so the first byte is enough.
+func isJSONObject(raw json.RawMessage) bool {
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	return len(raw) == 0 || raw[0] == '{' || bytes.Equal(raw, []byte("null"))
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"saber-websocket/models"
+	"strings"
+	"testing"
+)
+
+// Relay cost per message, from the wire bytes to the student_* message sent
+// to dashboards. "map" is the path before payloads were passed through raw:
+// decode the whole message into maps, then marshal the relay from them.
+// "splice" decodes only the envelope and splices the raw payload in.
+//
+//	go test ./handlers -run '^$' -bench Relay -benchmem
+
+// legacyMessage is the old fully decoded message form
+type legacyMessage struct {
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data"`
+}
+
+func legacyRelay(msgType, clientID string, in []byte) ([]byte, error) {
+	var msg legacyMessage
+	if err := json.Unmarshal(in, &msg); err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"type": msgType,
+		"data": map[string]interface{}{
+			"clientId": clientID,
+			"payload":  msg.Data,
+		},
+	})
+}
+
+func splicedRelay(msgType, clientID string, in []byte) ([]byte, error) {
+	var raw models.RawMessage
+	if err := json.Unmarshal(in, &raw); err != nil {
+		return nil, err
+	}
+	return relayEnvelope(msgType, clientID, raw.Data), nil
+}
+
+func screenshotMessage(imageBytes int) []byte {
+	image := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", imageBytes)))
+	in, _ := json.Marshal(map[string]interface{}{
+		"type": "screenshot",
+		"data": map[string]interface{}{"tabId": 7, "imageData": image},
+	})
+	return in
+}
+
+func tabsUpdateMessage(tabs int) []byte {
+	all := map[string]interface{}{}
+	for i := 0; i < tabs; i++ {
+		all[fmt.Sprint(i)] = map[string]interface{}{
+			"id":         i,
+			"title":      fmt.Sprintf("Worksheet %d - Google Docs", i),
+			"url":        fmt.Sprintf("https://docs.google.com/document/d/%040d/edit", i),
+			"active":     i == 0,
+			"favIconUrl": "https://ssl.gstatic.com/docs/documents/images/kix-favicon7.ico",
+		}
+	}
+	in, _ := json.Marshal(map[string]interface{}{"type": "tabs_update", "data": map[string]interface{}{"tabs": all}})
+	return in
+}
+
+func TestRelayEnvelopeMatchesLegacy(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"screenshot":  screenshotMessage(1024),
+		"tabs_update": tabsUpdateMessage(3),
+		"no data":     []byte(`{"type":"tab_removed"}`),
+	} {
+		legacy, err := legacyRelay("student_x", "s1", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spliced, _ := splicedRelay("student_x", "s1", in)
+		var want, got interface{}
+		json.Unmarshal(legacy, &want)
+		if err := json.Unmarshal(spliced, &got); err != nil {
+			t.Fatalf("%s: spliced relay is not JSON: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: spliced relay %s, legacy %s", name, spliced, legacy)
+		}
+	}
+}
+
+func benchRelay(b *testing.B, msgType string, in []byte) {
+	for name, relay := range map[string]func(string, string, []byte) ([]byte, error){
+		"map":    legacyRelay,
+		"splice": splicedRelay,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := relay(msgType, "student-1", in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRelayScreenshot(b *testing.B) {
+	benchRelay(b, "student_screenshot", screenshotMessage(1<<20))
+}
+
+func BenchmarkRelayTabsUpdate(b *testing.B) {
+	benchRelay(b, "student_tabs_update", tabsUpdateMessage(30))
+}
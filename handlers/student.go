@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"saber-websocket/auth"
 	"saber-websocket/config"
 	"saber-websocket/models"
 	"saber-websocket/server"
@@ -9,117 +11,193 @@ import (
 	"time"
 )
 
-func HandleStudentConnect(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	data, ok := msg.Data["clientId"]
-	if !ok { return }
-	
-	clientID, ok := data.(string)
-	if !ok { return }
+func HandleStudentConnect(client *models.Client, msg *models.StudentConnect, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
+	if !checkUnidentified(client, "student", logger) { return }
+	if !checkProtocol(client, cfg, logger) { return }
+	if !checkRoleOrigin(client, "student", cfg, logger) { return }
+
+	clientID := msg.ClientID
+	classCode := classCodeOrDefault(msg.ClassCode, cfg)
+
+	// Enrollment mode: identity must be vouched for before the hub sees it.
+	// The token binds the email exactly as sent, empty included.
+	if cfg.RequireEnrollmentTokens {
+		token := msg.EnrollmentToken
+		if err := verifyEnrollmentToken(token, clientID, msg.Email, classCode, cfg); err != nil {
+			logger.Warn(fmt.Sprintf("Student connect rejected for %q (%s) in %s from %s: %v",
+				msg.Email, clientID, classCode, client.Conn.RemoteAddr(), err))
+			code := ErrCodeAuthFailed
+			if token == "" {
+				code = ErrCodeAuthRequired
+			}
+			sendError(client, code, err.Error())
+			return
+		}
+	}
 
 	email := "N/A"
-	if emailData, ok := msg.Data["email"].(string); ok {
-		email = emailData
+	if msg.Email != "" {
+		email = msg.Email
 	}
-
-	client.ClientID = clientID
 	client.Email = email
-	client.ClientType = "student"
+	client.ClassCode = classCode
+	// Presented back to the hub so it can hand over the previous slot
+	client.ResumeToken = msg.ResumeToken
+	if client.Identify("student", clientID) != nil { return } // Closed meanwhile
 
 	hub.Register(client)
 }
 
-func HandleTabUpdate(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	if client.ClientType != "student" { return }
+// verifyEnrollmentToken checks that a student_connect is backed by a signed enrollment token
+func verifyEnrollmentToken(token, clientID, email, classCode string, cfg *config.Config) error {
+	if cfg.StudentTokenSecret == "" {
+		return fmt.Errorf("student enrollment is not configured on this server")
+	}
+	if token == "" {
+		return fmt.Errorf("enrollment token required")
+	}
+	_, err := auth.VerifyEnrollment([]byte(cfg.StudentTokenSecret), token, clientID, email, classCode)
+	return err
+}
+
+// HandleTabUpdate relays a tab event; tabs is the decoded tabs_update, nil for
+// the single-tab events
+func HandleTabUpdate(client *models.Client, msg models.RawMessage, tabs map[string]json.RawMessage, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+	if !isJSONObject(msg.Data) { return }
+	client.MarkActivity()
 
 	// Store tabs in memory if it's a full update
-	if msg.Type == "tabs_update" {
-		if tabs, ok := msg.Data["tabs"].(map[string]interface{}); ok {
-			client.SetCurrentTabs(tabs)
-		}
+	if tabs != nil {
+		client.SetCurrentTabs(tabs)
 	}
 
-	// 1. Relay payload preparation
-	relayMsg := map[string]interface{}{
-		"type": "student_" + msg.Type,
-		"data": map[string]interface{}{
-			"clientId": client.ClientID,
-			"payload":  msg.Data,
-		},
-	}
-	
+	// 1. Relay payload preparation (payload spliced in as received)
+	relayMsg := relayEnvelope("student_"+msg.Type, client.GetClientID(), msg.Data)
+
 	// 2. Control Message -> Use Standard Broadcast Channel
-	if data, err := json.Marshal(relayMsg); err == nil {
-		hub.Broadcast(&models.BroadcastMessage{
-			Target:  "teacher",
-			Message: data,
-		})
-	}
+	hub.Broadcast(&models.BroadcastMessage{
+		ClassCode: client.ClassCode,
+		Target:    models.TargetStaff,
+		Message:   relayMsg,
+	})
 }
 
 // HandleScreenshot implements the FAST-PATH Relay
-func HandleScreenshot(client *models.Client, msg models.Message, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
+func HandleScreenshot(client *models.Client, msg models.RawMessage, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
 	// 1. Validation
-	if client.ClientType != "student" { return }
-
-	// 2. Data Extraction & Relay Construction
-	relayMsg := map[string]interface{}{
-		"type": "student_screenshot",
-		"data": map[string]interface{}{
-			"clientId": client.ClientID,
-			"payload":  msg.Data, // Contains {tabId, imageData}
-		},
-	}
-	
-	finalBytes, err := json.Marshal(relayMsg)
-	if err != nil { return }
+	if client.GetClientType() != "student" { return }
+	if !isJSONObject(msg.Data) { return }
 
-	// 3. FAST-PATH: Direct Stream Injection
-	teacher := hub.GetTeacherSafe()
-	if teacher != nil {
-		select {
-		case teacher.Send <- finalBytes:
-			// Success
-		default:
-			// Drop frame if teacher is lagging (Backpressure)
-		}
+	// 2. Relay Construction: the multi-megabyte payload ({tabId, imageData})
+	// is copied once, never decoded
+	finalBytes := relayEnvelope("student_screenshot", client.GetClientID(), msg.Data)
+
+	// 3. FAST-PATH: Direct Stream Injection to every dashboard in the class
+	for _, teacher := range hub.GetStaffSafe(client.ClassCode) {
+		// Drop frame if teacher is lagging (Backpressure)
+		teacher.TrySend(finalBytes)
+	}
+	hub.RelayToRemoteStaff(client.ClassCode, finalBytes)
+}
+
+// HandleScreenshotFrame is the binary FAST-PATH: the image is never decoded,
+// only the header is restamped with the sender's clientId.
+func HandleScreenshotFrame(client *models.Client, data []byte, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+	if !client.HasCapability(models.CapBinary) {
+		sendError(client, ErrCodeProtocol, "Binary frames require the binary capability")
+		return
+	}
+
+	frame, err := models.DecodeScreenshotFrame(data)
+	if err != nil {
+		sendError(client, ErrCodeProtocol, err.Error())
+		return
+	}
+	// Never trust the clientId the student put in the header
+	frame.ClientID = client.GetClientID()
+	if frame.Timestamp == 0 {
+		frame.Timestamp = time.Now().UnixMilli()
 	}
+	finalBytes, err := models.EncodeScreenshotFrame(frame)
+	if err != nil { return }
+
+	models.SendScreenshotFrame(hub.GetStaffSafe(client.ClassCode), finalBytes)
+	hub.RelayToRemoteStaff(client.ClassCode, finalBytes)
 }
 
 // Added missing HandlePing
-func HandlePing(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	pongMsg := map[string]interface{}{
-		"type": "pong",
-		"data": map[string]interface{}{
-			"timestamp": time.Now().UnixMilli(),
-		},
+func HandlePing(client *models.Client, hub *server.Hub, logger *utils.Logger) {
+	pongMsg := models.Envelope{
+		Type: "pong",
+		Data: models.Pong{Timestamp: time.Now().UnixMilli()},
 	}
 
 	if data, err := json.Marshal(pongMsg); err == nil {
-		select {
-		case client.Send <- data:
-		default:
-			// Optimization: Don't log dropped pings
-		}
+		// Optimization: Don't log dropped pings
+		client.TrySend(data)
 	}
 }
 
 // Added missing HandleScreenshotError
-func HandleScreenshotError(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	if client.ClientType != "student" { return }
+func HandleScreenshotError(client *models.Client, msg models.RawMessage, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+	if !isJSONObject(msg.Data) { return }
 
 	// Just relay the error to the teacher so they know why the screen is black
-	relayMsg := map[string]interface{}{
-		"type": "student_" + msg.Type, // e.g., student_screenshot_error
-		"data": map[string]interface{}{
-			"clientId": client.ClientID,
-			"payload":  msg.Data,
-		},
+	// e.g., student_screenshot_error
+	hub.Broadcast(&models.BroadcastMessage{
+		ClassCode: client.ClassCode,
+		Target:    models.TargetStaff,
+		Message:   relayEnvelope("student_"+msg.Type, client.GetClientID(), msg.Data),
+	})
+}
+
+// HandleCommandAck passes a student's command_ack to the class loop, which
+// reports it to the dashboard that issued the command.
+func HandleCommandAck(client *models.Client, msg *models.CommandAck, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+
+	hub.CommandReply(client, &server.CommandReply{
+		CommandID: msg.CommandID,
+		ClientID:  client.GetClientID(),
+		State:     server.CommandAcknowledged,
+	})
+}
+
+// HandleCommandResult is HandleCommandAck for the final command_result
+func HandleCommandResult(client *models.Client, msg *models.CommandResult, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+
+	reply := &server.CommandReply{
+		CommandID: msg.CommandID,
+		ClientID:  client.GetClientID(),
+		State:     server.CommandCompleted,
+	}
+	if len(msg.Result) > 0 {
+		reply.Result = msg.Result
 	}
+	if msg.Error != "" {
+		reply.State = server.CommandFailed
+		reply.Reason = msg.Error
+	}
+	hub.CommandReply(client, reply)
+}
 
-	if data, err := json.Marshal(relayMsg); err == nil {
-		hub.Broadcast(&models.BroadcastMessage{
-			Target:  "teacher",
-			Message: data,
-		})
+// HandleActivity records the extension's idle detection (chrome.idle) so the
+// hub can tell a student who walked away from one who is just reading.
+func HandleActivity(client *models.Client, msg *models.Activity, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "student" { return }
+
+	at := time.Time{}
+	if msg.State == "active" {
+		at = time.Now()
+	}
+	if msg.LastInputAt > 0 {
+		if t := time.UnixMilli(msg.LastInputAt); t.Before(time.Now()) {
+			at = t
+		}
 	}
-}
\ No newline at end of file
+	client.SetActivityHint(msg.State, at)
+}
@@ -1,50 +1,170 @@
 package handlers
 
 import (
-	"encoding/json"
+	"fmt"
+	"saber-websocket/audit"
+	"saber-websocket/auth"
+	"saber-websocket/config"
 	"saber-websocket/models"
+	"saber-websocket/policy"
 	"saber-websocket/server"
 	"saber-websocket/utils"
 )
 
-func HandleTeacherConnect(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	client.ClientType = "teacher"
-	client.ClientID = "teacher"
-	client.Email = "Teacher Dashboard"
+func HandleTeacherConnect(client *models.Client, msg *models.TeacherConnect, hub *server.Hub, cfg *config.Config, logger *utils.Logger) {
+	if !checkUnidentified(client, "teacher", logger) {
+		return
+	}
+	if !checkProtocol(client, cfg, logger) {
+		return
+	}
+	if !checkRoleOrigin(client, "teacher", cfg, logger) {
+		return
+	}
+
+	classCode := classCodeOrDefault(msg.ClassCode, cfg)
+
+	teacherID := "teacher"
+	email := "Teacher Dashboard"
+	role := models.RoleOwner
+
+	token := msg.Token
+	if token != "" || !cfg.AllowInsecureTeachers {
+		claims, code, err := verifyTeacherToken(token, classCode, cfg)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Teacher connect rejected for %s from %s: %v",
+				classCode, client.Conn.RemoteAddr(), err))
+			sendError(client, code, err.Error())
+			return
+		}
+		teacherID = claims.Subject
+		if claims.Email != "" {
+			email = claims.Email
+		}
+		role = claims.RoleFor(classCode)
+	}
+
+	client.ClassCode = classCode
+	client.Email = email
+	client.RequestedRole = role
+	if client.Identify("teacher", teacherID) != nil {
+		return // Closed meanwhile
+	}
 	hub.Register(client)
 }
 
-func HandleTeacherCommand(client *models.Client, msg models.Message, hub *server.Hub, logger *utils.Logger) {
-	if client.ClientType != "teacher" { return }
-
-	targetClientID, _ := msg.Data["targetClientId"].(string)
-	command, _ := msg.Data["command"].(string)
-
-	// Direct lookup for command routing
-	student := hub.GetStudentSafe(targetClientID)
-	
-	if student == nil {
-		// Notify teacher of failure
-		failMsg, _ := json.Marshal(map[string]interface{}{
-			"type": "command_failed",
-			"data": map[string]interface{}{
-				"targetClientId": targetClientID,
-				"reason":         "Student not found",
-			},
+// verifyTeacherToken checks a teacher_connect token and maps failures onto error codes
+func verifyTeacherToken(token, classCode string, cfg *config.Config) (*auth.TeacherClaims, string, error) {
+	if cfg.TeacherTokenSecret == "" {
+		return nil, ErrCodeAuthFailed, fmt.Errorf("teacher authentication is not configured on this server")
+	}
+	if token == "" {
+		return nil, ErrCodeAuthRequired, fmt.Errorf("teacher token required")
+	}
+	claims, err := auth.VerifyTeacher([]byte(cfg.TeacherTokenSecret), token, classCode)
+	if err == auth.ErrClassNotAllowed {
+		return nil, ErrCodeForbidden, err
+	}
+	if err != nil {
+		return nil, ErrCodeAuthFailed, err
+	}
+	return claims, "", nil
+}
+
+func HandleTeacherCommand(client *models.Client, msg *models.TeacherCommand, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "teacher" { return }
+	if !authorizeCommand(client, msg, hub, logger) { return }
+
+	// The class loop routes it (locally or through the backplane) and
+	// reports delivery, acks and timeouts back to this dashboard
+	hub.SendCommand(&server.Command{
+		Issuer:    client,
+		Target:    msg.TargetClientID,
+		Name:      msg.Command,
+		Data:      msg.Data,
+		RequestID: msg.RequestID,
+	})
+}
+
+// HandleTeacherBroadcast sends a command to the whole class. It goes through
+// the same role and policy checks as a single command.
+func HandleTeacherBroadcast(client *models.Client, msg *models.TeacherBroadcast, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "teacher" { return }
+	cmd := &models.TeacherCommand{
+		TargetClientID: audit.AllStudents,
+		Command:        msg.Command,
+		Data:           msg.Data,
+		RequestID:      msg.RequestID,
+	}
+	if !authorizeCommand(client, cmd, hub, logger) { return }
+
+	hub.SendCommand(&server.Command{
+		Issuer:    client,
+		Broadcast: true,
+		Name:      msg.Command,
+		Data:      msg.Data,
+		RequestID: msg.RequestID,
+	})
+}
+
+// HandleTeacherKick disconnects a student and releases its slot. Observers
+// can't kick, same as they can't send commands.
+func HandleTeacherKick(client *models.Client, msg *models.TeacherKick, hub *server.Hub, logger *utils.Logger) {
+	if client.GetClientType() != "teacher" { return }
+	if !models.CanCommand(client.GetRole()) {
+		hub.AuditLog().Record(audit.Entry{
+			Event:     audit.EventKick,
+			ClassCode: client.ClassCode,
+			TeacherID: client.GetClientID(),
+			Role:      client.GetRole(),
+			StudentID: msg.TargetClientID,
+			Detail:    "denied: " + policy.ReasonRoleNotAllowed,
+			RemoteIP:  client.RemoteIP,
 		})
-		client.Send <- failMsg
+		sendError(client, ErrCodeForbidden, "Observers cannot kick students")
 		return
 	}
+	logger.Info(fmt.Sprintf("Kick %s from %s requested by %s", msg.TargetClientID, client.ClassCode, client.GetClientID()))
+	hub.Kick(&server.Kick{Issuer: client, Target: msg.TargetClientID, Reason: msg.Reason})
+}
 
-	// Send command to student
-	commandMsg, _ := json.Marshal(map[string]interface{}{
-		"command": command,
-		"data":    msg.Data["data"],
-	})
-	
-	select {
-	case student.Send <- commandMsg:
-	default:
-		logger.Warn("Command dropped, student buffer full")
+// authorizeCommand checks the sender's role and the command policy, and
+// reports (and audits) a refusal to the dashboard
+func authorizeCommand(client *models.Client, msg *models.TeacherCommand, hub *server.Hub, logger *utils.Logger) bool {
+	if !models.CanCommand(client.GetRole()) {
+		auditDenied(client, msg, policy.ReasonRoleNotAllowed, hub)
+		sendError(client, ErrCodeForbidden, "Observers cannot send commands")
+		return false
+	}
+	if denial := hub.CommandPolicy().Authorize(client.ClassCode, client.GetRole(), msg.Command, msg.Data); denial != nil {
+		auditDenied(client, msg, denial.Reason, hub)
+		logger.Warn(fmt.Sprintf("Refused %s from %s (%s) in %s: %s",
+			msg.Command, client.GetClientID(), client.GetRole(), client.ClassCode, denial.Reason))
+		sendErrorData(client, ErrCodeCommandDenied, denial.Message, models.CommandDenied{
+			Command:        msg.Command,
+			TargetClientID: msg.TargetClientID,
+			RequestID:      msg.RequestID,
+			Reason:         denial.Reason,
+			Field:          denial.Field,
+			Rule:           denial.Rule,
+		})
+		return false
 	}
-}
\ No newline at end of file
+	return true
+}
+
+// auditDenied records a command that never reached the class loop
+func auditDenied(client *models.Client, msg *models.TeacherCommand, reason string, hub *server.Hub) {
+	hub.AuditLog().Record(audit.Entry{
+		Event:     audit.EventCommandDenied,
+		ClassCode: client.ClassCode,
+		TeacherID: client.GetClientID(),
+		Role:      client.GetRole(),
+		StudentID: msg.TargetClientID,
+		Command:   msg.Command,
+		RequestID: msg.RequestID,
+		Data:      msg.Data,
+		Detail:    reason,
+		RemoteIP:  client.RemoteIP,
+	})
+}
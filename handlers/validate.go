@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"saber-websocket/models"
+	"saber-websocket/schema"
+	"saber-websocket/utils"
+	"strings"
+)
+
+// Error codes kept for fields whose violations had their own code before
+// validation was centralised, so older extensions still recognise them
+var fieldErrorCodes = map[string]string{
+	"data.classCode": ErrCodeInvalidClass,
+}
+
+// decodeMessage unpacks a message's data into its typed struct and checks it
+// against the struct's validate tags. Violations are answered with an error
+// naming the field, and reported as false.
+func decodeMessage(client *models.Client, raw models.RawMessage, v interface{}, logger *utils.Logger) bool {
+	return checkDecoded(client, raw, v, decodeData(raw.Data, v), logger)
+}
+
+// decodeRelay is decodeMessage for the relayed student messages, whose data
+// is passed on to dashboards as received. It decodes with decodeFields, so a
+// screenshot's image is skipped over rather than parsed a second time.
+func decodeRelay(client *models.Client, raw models.RawMessage, v interface{}, logger *utils.Logger) bool {
+	return checkDecoded(client, raw, v, decodeFields(raw.Data, v), logger)
+}
+
+func checkDecoded(client *models.Client, raw models.RawMessage, v interface{}, err error, logger *utils.Logger) bool {
+	if err == nil {
+		err = schema.Validate(v)
+	}
+	if err == nil {
+		return true
+	}
+
+	fieldErr, ok := err.(*schema.FieldError)
+	if !ok {
+		fieldErr = &schema.FieldError{Field: "data", Rule: "type", Message: err.Error()}
+	}
+	logger.Warn(fmt.Sprintf("Rejected %s from %s: %s", raw.Type, describeSender(client), fieldErr))
+
+	code := ErrCodeInvalidMessage
+	if c, ok := fieldErrorCodes[fieldErr.Field]; ok {
+		code = c
+	}
+	sendErrorData(client, code, fieldErr.Error(), models.ValidationDetail{
+		MessageType: raw.Type,
+		Field:       fieldErr.Field,
+		Rule:        fieldErr.Rule,
+	})
+	return false
+}
+
+// decodeData unmarshals message data, turning type mismatches into field errors
+func decodeData(data json.RawMessage, v interface{}) error {
+	if isNull(data) {
+		return nil // Left to the required rules
+	}
+	return typeError("data", json.Unmarshal(data, v))
+}
+
+// decodeFields fills the struct v points to from the top-level fields of
+// data, decoding each field on its own. Fields that decode themselves (like
+// models.DataURL) get their raw bytes without encoding/json checking them
+// first, which is safe because readPump already parsed the whole message.
+// Field names match case-insensitively, as with json.Unmarshal.
+func decodeFields(data json.RawMessage, v interface{}) error {
+	if isNull(data) {
+		return nil
+	}
+	fields, err := splitObject(data)
+	if err != nil {
+		return &schema.FieldError{Field: "data", Rule: "type", Message: "must be an object"}
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		value, ok := fields[name]
+		if !ok {
+			for key, v := range fields {
+				if strings.EqualFold(key, name) {
+					value, ok = v, true
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		target := rv.Field(i).Addr().Interface()
+		if u, isUnmarshaler := target.(json.Unmarshaler); isUnmarshaler {
+			err = u.UnmarshalJSON(value)
+		} else {
+			err = json.Unmarshal(value, target)
+		}
+		if err = typeError("data."+name, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeError turns a json type mismatch into a field error under path
+func typeError(path string, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	field := path
+	if typeErr.Field != "" {
+		field += "." + typeErr.Field
+	}
+	return &schema.FieldError{
+		Field:   field,
+		Rule:    "type",
+		Message: fmt.Sprintf("must be %s, not %s", jsonTypeName(typeErr.Type), typeErr.Value),
+	}
+}
+
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || bytes.Equal(data, []byte("null"))
+}
+
+var errNotObject = errors.New("not a JSON object")
+
+// splitObject returns the raw value of each top-level field of a JSON
+// object. The input must already be known to be valid JSON: this only finds
+// where values end, jumping from quote to quote inside strings instead of
+// stepping through every byte the way encoding/json has to.
+func splitObject(data []byte) (map[string]json.RawMessage, error) {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil, errNotObject
+	}
+	fields := make(map[string]json.RawMessage)
+	for i++; ; {
+		i = skipSpace(data, i)
+		if i >= len(data) {
+			return nil, errNotObject
+		}
+		switch data[i] {
+		case '}':
+			return fields, nil
+		case ',':
+			i++
+			continue
+		case '"':
+		default:
+			return nil, errNotObject
+		}
+
+		keyEnd, err := skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		key := string(data[i+1 : keyEnd-1])
+		if bytes.IndexByte(data[i:keyEnd], '\\') >= 0 {
+			if err := json.Unmarshal(data[i:keyEnd], &key); err != nil {
+				return nil, err
+			}
+		}
+		i = skipSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return nil, errNotObject
+		}
+		i = skipSpace(data, i+1)
+		end, err := skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = data[i:end]
+		i = end
+	}
+}
+
+// skipValue returns the index just past the JSON value starting at i
+func skipValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, errNotObject
+	}
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				end, err := skipString(data, i)
+				if err != nil {
+					return 0, err
+				}
+				i = end
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1, nil
+				}
+			}
+			i++
+		}
+		return 0, errNotObject
+	}
+	// A number, true, false or null runs up to the next delimiter
+	for i < len(data) {
+		switch data[i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			return i, nil
+		}
+		i++
+	}
+	return i, nil
+}
+
+// skipString returns the index just past the string whose opening quote is at i
+func skipString(data []byte, i int) (int, error) {
+	start := i + 1
+	for i = start; ; i++ {
+		quote := bytes.IndexByte(data[i:], '"')
+		if quote < 0 {
+			return 0, errNotObject
+		}
+		i += quote
+		// Escaped if preceded by an odd number of backslashes
+		escapes := 0
+		for j := i - 1; j >= start && data[j] == '\\'; j-- {
+			escapes++
+		}
+		if escapes%2 == 0 {
+			return i + 1, nil
+		}
+	}
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// jsonTypeName names a Go type the way a JSON sender would think of it
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	}
+	return "a number"
+}
+
+// describeSender identifies a client in logs, before or after it registered
+func describeSender(client *models.Client) string {
+	if client.GetClientID() != "" {
+		return client.GetClientID()
+	}
+	if client.RemoteIP != "" {
+		return client.RemoteIP
+	}
+	return client.Conn.RemoteAddr().String()
+}
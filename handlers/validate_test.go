@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"saber-websocket/models"
+	"saber-websocket/schema"
+	"testing"
+)
+
+func TestSplitObject(t *testing.T) {
+	in := `{ "a" : 1, "b":"x\"}y\\", "c":{"d":[1,{"e":"]"}]}, "k\u0065y":null,"t":true }`
+	fields, err := splitObject([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a":   `1`,
+		"b":   `"x\"}y\\"`,
+		"c":   `{"d":[1,{"e":"]"}]}`,
+		"key": `null`,
+		"t":   `true`,
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d: %q", len(fields), len(want), fields)
+	}
+	for key, value := range want {
+		if string(fields[key]) != value {
+			t.Errorf("%s = %s, want %s", key, fields[key], value)
+		}
+	}
+
+	for _, bad := range []string{`[]`, `"s"`, `{"a":1`, `{"a":"open}`} {
+		if _, err := splitObject([]byte(bad)); err == nil {
+			t.Errorf("splitObject(%s) succeeded", bad)
+		}
+	}
+}
+
+// decodeFields has to agree with decodeData on every relay message
+func TestDecodeFieldsMatchesDecodeData(t *testing.T) {
+	cases := []struct {
+		data string
+		v    func() interface{}
+	}{
+		{`{"tabId":7,"imageData":"data:image/png;base64,AAAA"}`, func() interface{} { return &models.Screenshot{} }},
+		{`{"TABID":7,"imageData":"data:image/png;base64,AAAA","extra":[1]}`, func() interface{} { return &models.Screenshot{} }},
+		{`{"tabId":7,"imageData":"nope"}`, func() interface{} { return &models.Screenshot{} }},
+		{`{"tabId":"7","imageData":"data:image/png;base64,AAAA"}`, func() interface{} { return &models.Screenshot{} }},
+		{`{"tabs":{"1":{"url":"https://a.example"},"2":{}}}`, func() interface{} { return &models.TabsUpdate{} }},
+		{`{"tabs":[]}`, func() interface{} { return &models.TabsUpdate{} }},
+		{`{"tabId":3}`, func() interface{} { return &models.TabEvent{} }},
+		{`{"tabId":3,"error":"captureVisibleTab failed"}`, func() interface{} { return &models.ScreenshotError{} }},
+		{`null`, func() interface{} { return &models.ScreenshotError{} }},
+	}
+	for _, c := range cases {
+		want, got := c.v(), c.v()
+		wantErr := decodeData(json.RawMessage(c.data), want)
+		if wantErr == nil {
+			wantErr = schema.Validate(want)
+		}
+		gotErr := decodeFields(json.RawMessage(c.data), got)
+		if gotErr == nil {
+			gotErr = schema.Validate(got)
+		}
+		// After an error the struct is discarded, so only the error has to match
+		if !reflect.DeepEqual(gotErr, wantErr) || (wantErr == nil && !reflect.DeepEqual(got, want)) {
+			t.Errorf("%s:\n decodeFields %+v, %v\n decodeData   %+v, %v", c.data, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+// Validating a screenshot's data before relaying it
+//
+//	go test ./handlers -run '^$' -bench ValidateScreenshot -benchmem
+func BenchmarkValidateScreenshot(b *testing.B) {
+	var raw models.RawMessage
+	json.Unmarshal(screenshotMessage(1<<20), &raw)
+
+	for name, decode := range map[string]func(json.RawMessage, interface{}) error{
+		"unmarshal": decodeData,
+		"fields":    decodeFields,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(raw.Data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var msg models.Screenshot
+				if err := decode(raw.Data, &msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := schema.Validate(&msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
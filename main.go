@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"saber-websocket/audit"
+	"saber-websocket/backplane"
 	"saber-websocket/config"
 	"saber-websocket/handlers"
+	"saber-websocket/policy"
 	"saber-websocket/server"
 	"saber-websocket/utils"
 	"syscall"
@@ -22,10 +25,94 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 	logger.Info(fmt.Sprintf("Configuration loaded: Port=%s, MaxStudents=%d", cfg.Port, cfg.MaxStudents))
+	for _, warning := range cfg.Warnings() {
+		logger.Warn(warning)
+	}
+	if cfg.AllowInsecureTeachers {
+		logger.Warn("ALLOW_INSECURE_TEACHERS is set: teacher_connect without a token is accepted")
+	} else if cfg.TeacherTokenSecret == "" {
+		logger.Warn("TEACHER_TOKEN_SECRET is not set: all teacher connections will be refused")
+	}
+	if cfg.RequireEnrollmentTokens && cfg.StudentTokenSecret == "" {
+		logger.Warn("REQUIRE_ENROLLMENT_TOKENS is set without STUDENT_TOKEN_SECRET: all student connections will be refused")
+	}
+	if len(cfg.TeacherOrigins) == 0 {
+		logger.Warn("TEACHER_ALLOWED_ORIGINS is not set: any website can open a dashboard connection")
+	}
+	if len(cfg.StudentOrigins) == 0 {
+		logger.Warn("STUDENT_ALLOWED_ORIGINS is not set: students may connect from any origin")
+	}
+	if cfg.MaxConnectionsPerIP > 0 && len(cfg.TrustedProxies) == 0 {
+		logger.Warn("MAX_CONNECTIONS_PER_IP is set without TRUSTED_PROXIES: behind a load balancer every connection counts against the balancer's address")
+	}
 
 	// Create the hub (central message router)
 	hub := server.NewHub(cfg, logger)
-	go hub.Run()
+
+	if cfg.CommandPolicyFile != "" && len(cfg.AllowedCommands) > 0 {
+		logger.Error("ALLOWED_COMMANDS and COMMAND_POLICY_FILE are both set; list the commands in the policy file instead")
+		os.Exit(1)
+	}
+	if cfg.CommandPolicyFile != "" {
+		commandPolicy, err := policy.Load(cfg.CommandPolicyFile)
+		if err != nil {
+			logger.Error("Command policy: " + err.Error())
+			os.Exit(1)
+		}
+		hub.AttachCommandPolicy(commandPolicy)
+		logger.Info(fmt.Sprintf("Command policy loaded from %s: %d commands", cfg.CommandPolicyFile, len(commandPolicy.Commands)))
+	} else if len(cfg.AllowedCommands) > 0 {
+		commandPolicy, err := policy.Allowlist(cfg.AllowedCommands)
+		if err != nil {
+			logger.Error("ALLOWED_COMMANDS: " + err.Error())
+			os.Exit(1)
+		}
+		hub.AttachCommandPolicy(commandPolicy)
+		logger.Info(fmt.Sprintf("Commands limited to %v", cfg.AllowedCommands))
+	}
+
+	if cfg.AuditLogFile != "" {
+		// A broken chain is reported but doesn't stop the server; new
+		// entries chain on from the last readable one
+		if f, err := os.Open(cfg.AuditLogFile); err == nil {
+			if _, _, err := audit.Verify(f); err != nil {
+				logger.Error(fmt.Sprintf("Audit log %s failed verification: %v", cfg.AuditLogFile, err))
+			}
+			f.Close()
+		}
+		auditLog, err := audit.Open(cfg.AuditLogFile, cfg.InstanceID, logger)
+		if err != nil {
+			logger.Error("Audit log: " + err.Error())
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+		hub.AttachAuditLog(auditLog)
+		if seq, head := auditLog.Head(); seq > 0 {
+			logger.Info(fmt.Sprintf("Audit log %s: %d entries, head %s", cfg.AuditLogFile, seq, head))
+		} else {
+			logger.Info("Audit log " + cfg.AuditLogFile + " is empty")
+		}
+	}
+
+	// Link to other instances when running behind a load balancer
+	if cfg.BackplaneListen != "" {
+		peer, err := backplane.NewPeer(cfg.InstanceID, cfg.BackplaneListen, cfg.BackplaneSecret, cfg.BackplanePeers, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer peer.Close()
+		hub.AttachBackplane(peer)
+		logger.Info(fmt.Sprintf("Backplane instance %s listening on %s, peers=%v",
+			cfg.InstanceID, cfg.BackplaneListen, cfg.BackplanePeers))
+	}
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	defer stopHub()
+	hubDone := make(chan struct{})
+	go func() {
+		hub.Run(hubCtx)
+		close(hubDone)
+	}()
 
 	// Setup HTTP server with WebSocket endpoint
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -40,6 +127,10 @@ func main() {
 		handlers.ServeWs(hub, w, r, cfg, logger)
 	})
 
+	http.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ServeAudit(hub, w, r, cfg, logger)
+	})
+
 	// Health check endpoint for Render
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -73,12 +164,25 @@ func main() {
 	logger.Info("Shutting down server...")
 
 	// Shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
+	// Stop accepting upgrades first; hijacked WebSockets are not tracked by
+	// http.Server, so the hub drains those itself
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Error(fmt.Sprintf("Server forced to shutdown: %v", err))
 	}
 
+	drained, err := hub.Shutdown(ctx)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Hub drain incomplete: %v", err))
+	}
+	logger.Info(fmt.Sprintf("Drained %d WebSocket clients", drained))
+	stopHub()
+	select {
+	case <-hubDone:
+	case <-ctx.Done():
+	}
+
 	logger.Info("Server stopped")
 }
\ No newline at end of file
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Binary frames carry screenshots without the base64/JSON overhead:
+//
+//	"SB" | type u8 | clientId len u8 | clientId | tabId i64 | timestamp i64 (ms) | image bytes
+//
+// Integers are big-endian. Students may leave clientId empty; the server
+// always stamps the registered clientId before relaying to staff.
+//
+// Connections on length-prefixed framing also get batch frames:
+//
+//	"SB" | 2 | (length u32 | message)...
+//
+// where each message is exactly what would otherwise have been sent as a
+// frame of its own: JSON, a codec message, or a screenshot frame.
+const (
+	FrameMagic      = "SB"
+	FrameScreenshot = 1
+	FrameBatch      = 2
+
+	frameFixedLen = 2 + 1 + 1 + 8 + 8
+)
+
+var (
+	ErrFrameMalformed = errors.New("malformed binary frame")
+	ErrFrameType      = errors.New("unknown binary frame type")
+	ErrFrameClientID  = errors.New("clientId too long for a binary frame")
+)
+
+// ScreenshotFrame is the decoded form of a FrameScreenshot
+type ScreenshotFrame struct {
+	ClientID  string
+	TabID     int64
+	Timestamp int64 // Unix milliseconds
+	Image     []byte
+}
+
+// IsBinaryFrame reports whether an outbound message is a binary frame.
+// JSON messages always start with '{' or '[', so the magic can't collide.
+func IsBinaryFrame(msg []byte) bool {
+	return len(msg) >= 2 && msg[0] == FrameMagic[0] && msg[1] == FrameMagic[1]
+}
+
+// EncodeScreenshotFrame builds the wire form of a screenshot frame
+func EncodeScreenshotFrame(f *ScreenshotFrame) ([]byte, error) {
+	if len(f.ClientID) > 255 {
+		return nil, ErrFrameClientID
+	}
+	buf := make([]byte, frameFixedLen+len(f.ClientID)+len(f.Image))
+	copy(buf, FrameMagic)
+	buf[2] = FrameScreenshot
+	buf[3] = byte(len(f.ClientID))
+	n := 4 + copy(buf[4:], f.ClientID)
+	binary.BigEndian.PutUint64(buf[n:], uint64(f.TabID))
+	binary.BigEndian.PutUint64(buf[n+8:], uint64(f.Timestamp))
+	copy(buf[n+16:], f.Image)
+	return buf, nil
+}
+
+// DecodeScreenshotFrame parses a screenshot frame. Image aliases msg.
+func DecodeScreenshotFrame(msg []byte) (*ScreenshotFrame, error) {
+	if len(msg) < frameFixedLen || !IsBinaryFrame(msg) {
+		return nil, ErrFrameMalformed
+	}
+	if msg[2] != FrameScreenshot {
+		return nil, ErrFrameType
+	}
+	idLen := int(msg[3])
+	if len(msg) < frameFixedLen+idLen {
+		return nil, ErrFrameMalformed
+	}
+	n := 4 + idLen
+	return &ScreenshotFrame{
+		ClientID:  string(msg[4:n]),
+		TabID:     int64(binary.BigEndian.Uint64(msg[n:])),
+		Timestamp: int64(binary.BigEndian.Uint64(msg[n+8:])),
+		Image:     msg[n+16:],
+	}, nil
+}
+
+// LegacyScreenshotJSON converts a screenshot frame into the student_screenshot
+// message that dashboards without the binary capability understand
+func LegacyScreenshotJSON(msg []byte) ([]byte, error) {
+	f, err := DecodeScreenshotFrame(msg)
+	if err != nil {
+		return nil, err
+	}
+	dataURL := "data:" + http.DetectContentType(f.Image) + ";base64," + base64.StdEncoding.EncodeToString(f.Image)
+	return json.Marshal(Envelope{
+		Type: "student_screenshot",
+		Data: StudentEvent{
+			ClientID: f.ClientID,
+			Payload: map[string]interface{}{
+				"tabId":     f.TabID,
+				"imageData": dataURL,
+				"timestamp": f.Timestamp,
+			},
+		},
+	})
+}
+
+// SendScreenshotFrame fans a screenshot frame out to dashboards, converting it
+// once to legacy JSON for those without the binary capability. Like every
+// screenshot send it drops the frame for clients whose buffer is full.
+func SendScreenshotFrame(clients []*Client, frame []byte) {
+	var legacy []byte
+	for _, c := range clients {
+		if c.HasCapability(CapBinary) {
+			c.TrySend(frame)
+			continue
+		}
+		if legacy == nil {
+			var err error
+			if legacy, err = LegacyScreenshotJSON(frame); err != nil {
+				return
+			}
+		}
+		c.TrySend(legacy)
+	}
+}
@@ -0,0 +1,395 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+//go:generate go run ../cmd/schemagen -out ../schemas
+
+// Typed protocol messages. Inbound structs carry `validate` tags that the
+// handlers check before a message is routed (see the schema package);
+// cmd/schemagen turns both directions into JSON Schema for the extension
+// and dashboard teams.
+
+// --- Inbound: extension and dashboard to server ---
+
+// Hello opens the protocol negotiation (see protocol.go)
+type Hello struct {
+	Version      int      `json:"version,omitempty" validate:"min=1" desc:"Single protocol version offered"`
+	Versions     []int    `json:"versions,omitempty" validate:"max=16" desc:"Protocol versions offered; the highest shared one wins"`
+	Capabilities []string `json:"capabilities,omitempty" validate:"max=16" desc:"Optional features requested; unknown ones are ignored"`
+	Codec        string   `json:"codec,omitempty" validate:"max=32" desc:"Binary codec (json, msgpack or cbor); unknown ones fall back to json"`
+	Framing      string   `json:"framing,omitempty" validate:"max=32" desc:"Batch framing (newline, array or length_prefixed)"`
+}
+
+// StudentConnect registers an extension with a class
+type StudentConnect struct {
+	ClientID        string `json:"clientId" validate:"required,max=128,format=id"`
+	Email           string `json:"email,omitempty" validate:"max=254"`
+	ClassCode       string `json:"classCode,omitempty" validate:"format=classCode" desc:"Omitted by extensions that predate classes"`
+	EnrollmentToken string `json:"enrollmentToken,omitempty" validate:"max=4096" desc:"Required when the server runs in enrollment mode"`
+	ResumeToken     string `json:"resumeToken,omitempty" validate:"max=128" desc:"From the last student_registered, to reclaim the slot"`
+}
+
+// TeacherConnect registers a dashboard with a class
+type TeacherConnect struct {
+	ClassCode string `json:"classCode,omitempty" validate:"format=classCode"`
+	Token     string `json:"token,omitempty" validate:"max=4096" desc:"Signed teacher token"`
+}
+
+// TeacherCommand asks the server to deliver a command to one student
+type TeacherCommand struct {
+	TargetClientID string          `json:"targetClientId" validate:"required,max=160,format=deviceId"`
+	Command        string          `json:"command" validate:"required,max=64,format=command"`
+	Data           json.RawMessage `json:"data,omitempty" desc:"Passed to the extension untouched"`
+	RequestID      string          `json:"requestId,omitempty" validate:"max=128,format=id" desc:"Echoed back in command_status"`
+}
+
+// TeacherBroadcast asks the server to deliver a command to every student in
+// the class. Broadcasts are not tracked: extensions don't ack them.
+type TeacherBroadcast struct {
+	Command   string          `json:"command" validate:"required,max=64,format=command"`
+	Data      json.RawMessage `json:"data,omitempty" desc:"Passed to the extensions untouched"`
+	RequestID string          `json:"requestId,omitempty" validate:"max=128,format=id"`
+}
+
+// TeacherKick asks the server to disconnect one student and release its slot
+type TeacherKick struct {
+	TargetClientID string `json:"targetClientId" validate:"required,max=160,format=deviceId"`
+	Reason         string `json:"reason,omitempty" validate:"max=256" desc:"Passed on to the student"`
+}
+
+// CommandAck is the extension confirming it received a command
+type CommandAck struct {
+	CommandID string `json:"commandId" validate:"required,max=64,format=id"`
+}
+
+// CommandResult is the extension reporting how a command went
+type CommandResult struct {
+	CommandID string          `json:"commandId" validate:"required,max=64,format=id"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty" validate:"max=1024" desc:"Set when the command failed"`
+}
+
+// Activity is the extension's idle detection (chrome.idle)
+type Activity struct {
+	State       string `json:"state" validate:"required,oneof=active idle locked"`
+	LastInputAt int64  `json:"lastInputAt,omitempty" validate:"min=0" desc:"Unix milliseconds of the last user input"`
+}
+
+// TabsUpdate is the full set of a student's open tabs. Like the other relay
+// messages it reaches dashboards exactly as sent.
+type TabsUpdate struct {
+	Tabs map[string]json.RawMessage `json:"tabs" validate:"required,max=1000" desc:"Tabs keyed by tab ID"`
+}
+
+// TabEvent is a single tab_created, tab_updated or tab_removed
+type TabEvent struct {
+	TabID int64 `json:"tabId,omitempty"`
+}
+
+// Screenshot is a JSON tab capture, for extensions without binary frames
+type Screenshot struct {
+	TabID     int64   `json:"tabId"`
+	ImageData DataURL `json:"imageData" validate:"required"`
+}
+
+// ScreenshotError explains a screenshot_error or screenshot_skipped
+type ScreenshotError struct {
+	TabID  int64  `json:"tabId,omitempty"`
+	Error  string `json:"error,omitempty" validate:"max=1024"`
+	Reason string `json:"reason,omitempty" validate:"max=256"`
+}
+
+// DataURL is a base64 image data URL. Decoding only notes its shape and
+// keeps nothing, so a multi-megabyte screenshot is never copied just to be
+// validated.
+type DataURL struct {
+	MediaType string // Empty if the value wasn't an image data URL
+	Size      int
+}
+
+var errNotDataURL = errors.New("must be a base64 image data URL")
+
+func (d *DataURL) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	// Shape problems are reported by Validate, which knows the field's path
+	d.Size = len(b)
+	end := bytes.Index(b, []byte(";base64,"))
+	if bytes.HasPrefix(b, []byte(`"data:image/`)) && end > 0 && b[len(b)-1] == '"' {
+		d.MediaType = string(b[len(`"data:`):end])
+	}
+	return nil
+}
+
+func (d DataURL) Validate() error {
+	if d.MediaType == "" {
+		return errNotDataURL
+	}
+	return nil
+}
+
+func (DataURL) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "string",
+		"pattern": "^data:image/[A-Za-z0-9.+-]+;base64,",
+	}
+}
+
+// --- Outbound: server to extension and dashboard ---
+
+// Envelope is the {type, data} shape of every outbound message
+type Envelope struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// ErrorReply rejects a message; code is machine readable
+type ErrorReply struct {
+	Type    string      `json:"type" validate:"oneof=error"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty" desc:"ValidationDetail for invalid_message, VersionRange for unsupported_version, RateLimitDetail for rate_limited, CommandDenied for command_denied"`
+}
+
+// ValidationDetail says which field of a rejected message was wrong
+type ValidationDetail struct {
+	MessageType string `json:"messageType"`
+	Field       string `json:"field" desc:"JSON path, e.g. data.clientId"`
+	Rule        string `json:"rule"`
+}
+
+// VersionRange lists the protocol versions the server speaks
+type VersionRange struct {
+	MinVersion int `json:"minVersion"`
+	MaxVersion int `json:"maxVersion"`
+}
+
+// RateLimitDetail tells a client which limit it is running into
+type RateLimitDetail struct {
+	MessageType string  `json:"messageType"`
+	Limit       string  `json:"limit" desc:"messages, screenshots, tab_events, commands or size"`
+	PerSecond   float64 `json:"perSecond,omitempty"`
+	Dropped     int     `json:"dropped" desc:"Messages dropped in the current window"`
+}
+
+// CommandDenied explains why the command policy refused a teacher_command
+type CommandDenied struct {
+	Command        string `json:"command"`
+	TargetClientID string `json:"targetClientId" desc:"\"*\" for a teacher_broadcast"`
+	RequestID      string `json:"requestId,omitempty"`
+	Reason         string `json:"reason" validate:"oneof=unknown_command role_not_allowed class_restricted invalid_args"`
+	Field          string `json:"field,omitempty" desc:"The offending argument, for invalid_args"`
+	Rule           string `json:"rule,omitempty"`
+}
+
+// HelloAck settles the protocol negotiation
+type HelloAck struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Codec        string   `json:"codec"`
+	Framing      string   `json:"framing"`
+	MinVersion   int      `json:"minVersion"`
+	MaxVersion   int      `json:"maxVersion"`
+}
+
+// Pong answers an application-level ping
+type Pong struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// StudentRegistered confirms a student_connect
+type StudentRegistered struct {
+	ClientID       string `json:"clientId" desc:"May carry a #n device suffix under the multi duplicate policy"`
+	ClassCode      string `json:"classCode"`
+	ResumeToken    string `json:"resumeToken"`
+	ResumeWindowMs int64  `json:"resumeWindowMs"`
+	Resumed        bool   `json:"resumed"`
+}
+
+// TeacherRegistered confirms a teacher_connect with the role granted
+type TeacherRegistered struct {
+	ClassCode string        `json:"classCode"`
+	Role      string        `json:"role" validate:"oneof=owner co_teacher observer"`
+	Reason    string        `json:"reason"`
+	Staff     []StaffMember `json:"staff"`
+}
+
+// StaffMember is one dashboard on a class; also the data of staff_joined,
+// staff_left and staff_role_changed
+type StaffMember struct {
+	TeacherID string `json:"teacherId"`
+	Email     string `json:"email"`
+	Role      string `json:"role" validate:"oneof=owner co_teacher observer"`
+}
+
+// SessionDisplaced tells a teacher another dashboard took over the class
+type SessionDisplaced struct {
+	Reason    string `json:"reason"`
+	TeacherID string `json:"teacherId"`
+}
+
+// SessionReplaced tells a student a newer connection took over its clientId
+type SessionReplaced struct {
+	ClientID string `json:"clientId"`
+	Reason   string `json:"reason"`
+}
+
+// Kicked tells a student a teacher removed it from the class
+type Kicked struct {
+	ClientID string `json:"clientId"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// StudentDuplicate tells staff how a duplicate clientId was handled
+type StudentDuplicate struct {
+	ClientID     string `json:"clientId"`
+	BaseClientID string `json:"baseClientId"`
+	Policy       string `json:"policy"`
+	Action       string `json:"action"`
+}
+
+// StudentConnected tells staff a student joined the class
+type StudentConnected struct {
+	ClientID string `json:"clientId"`
+	Email    string `json:"email"`
+}
+
+// StudentDisconnected tells staff a student left for good
+type StudentDisconnected struct {
+	ClientID string `json:"clientId"`
+}
+
+// RosterEntry is one student of initial_student_list
+type RosterEntry struct {
+	ClientID string `json:"clientId"`
+	Email    string `json:"email"`
+	Presence string `json:"presence,omitempty" desc:"Only for students connected to this instance"`
+}
+
+// StudentPresence reports a presence transition
+type StudentPresence struct {
+	ClientID       string `json:"clientId"`
+	State          string `json:"state" validate:"oneof=active idle unresponsive"`
+	Previous       string `json:"previous"`
+	Since          int64  `json:"since"`
+	LastSeen       int64  `json:"lastSeen"`
+	LastActivityAt int64  `json:"lastActivityAt"`
+}
+
+// StudentResync replaces what a dashboard knew about one student after it
+// missed numbered messages about them
+type StudentResync struct {
+	ClientID string                     `json:"clientId"`
+	Missed   [][2]uint64                `json:"missed" desc:"Sequence numbers replaced, as [from, to] ranges"`
+	State    string                     `json:"state" validate:"oneof=connected reconnecting disconnected"`
+	Email    string                     `json:"email,omitempty"`
+	Presence string                     `json:"presence,omitempty"`
+	Tabs     map[string]json.RawMessage `json:"tabs"`
+	Remote   bool                       `json:"remote,omitempty" desc:"Connected to another instance; tabs are not known here"`
+}
+
+// StudentEvent relays a student's message (student_tabs_update,
+// student_screenshot, ...) to staff; the payload is exactly what it sent
+type StudentEvent struct {
+	ClientID string      `json:"clientId"`
+	Payload  interface{} `json:"payload"`
+}
+
+// StudentCommand delivers a teacher command to an extension. Unlike every
+// other message it has no type.
+type StudentCommand struct {
+	Command   string      `json:"command"`
+	Data      interface{} `json:"data"`
+	CommandID string      `json:"commandId"`
+}
+
+// CommandStatus reports a command's progress to the dashboard that sent it
+type CommandStatus struct {
+	CommandID      string      `json:"commandId"`
+	TargetClientID string      `json:"targetClientId"`
+	Command        string      `json:"command"`
+	State          string      `json:"state" validate:"oneof=delivered acknowledged completed failed timed_out"`
+	RequestID      string      `json:"requestId,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	Result         interface{} `json:"result,omitempty"`
+}
+
+// CommandFailed is the failure report for dashboards without acks
+type CommandFailed struct {
+	TargetClientID string `json:"targetClientId"`
+	Reason         string `json:"reason"`
+}
+
+// ServerShutdown asks clients to reconnect elsewhere after a delay
+type ServerShutdown struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnectAfterMs"`
+}
+
+// --- Catalogue ---
+
+// MessageDoc describes one message type for schema generation
+type MessageDoc struct {
+	Type        string
+	Description string
+	Data        interface{} // Zero value of the data struct; nil when there is none
+	Whole       bool        // Data describes the whole message rather than its data field
+}
+
+// InboundMessages lists every message clients may send
+var InboundMessages = []MessageDoc{
+	{Type: "hello", Description: "Negotiates protocol version, capabilities, codec and framing; sent before connecting", Data: Hello{}},
+	{Type: "student_connect", Description: "Registers a student extension with a class", Data: StudentConnect{}},
+	{Type: "teacher_connect", Description: "Registers a teacher dashboard with a class", Data: TeacherConnect{}},
+	{Type: "ping", Description: "Application-level keepalive, answered with pong"},
+	{Type: "activity", Description: "Student idle state from chrome.idle", Data: Activity{}},
+	{Type: "tabs_update", Description: "All of a student's open tabs", Data: TabsUpdate{}},
+	{Type: "tab_created", Description: "A student opened a tab", Data: TabEvent{}},
+	{Type: "tab_updated", Description: "A student's tab changed", Data: TabEvent{}},
+	{Type: "tab_removed", Description: "A student closed a tab", Data: TabEvent{}},
+	{Type: "screenshot", Description: "Tab capture as a data URL (binary frames are preferred once negotiated)", Data: Screenshot{}},
+	{Type: "screenshot_error", Description: "A capture failed", Data: ScreenshotError{}},
+	{Type: "screenshot_skipped", Description: "A capture was skipped on purpose", Data: ScreenshotError{}},
+	{Type: "command_ack", Description: "The extension received a command", Data: CommandAck{}},
+	{Type: "command_result", Description: "The extension finished a command", Data: CommandResult{}},
+	{Type: "teacher_command", Description: "A dashboard sends a command to one student", Data: TeacherCommand{}},
+	{Type: "teacher_broadcast", Description: "A dashboard sends a command to every student in the class", Data: TeacherBroadcast{}},
+	{Type: "teacher_kick", Description: "A dashboard disconnects a student", Data: TeacherKick{}},
+}
+
+// OutboundMessages lists every message the server sends
+var OutboundMessages = []MessageDoc{
+	{Type: "error", Description: "A message was rejected", Data: ErrorReply{}, Whole: true},
+	{Type: "hello_ack", Description: "Settles the hello negotiation", Data: HelloAck{}},
+	{Type: "pong", Description: "Answers ping", Data: Pong{}},
+	{Type: "server_shutdown", Description: "The instance is going away; reconnect after the delay", Data: ServerShutdown{}},
+	{Type: "student_registered", Description: "Confirms student_connect", Data: StudentRegistered{}},
+	{Type: "session_replaced", Description: "A newer connection took over this clientId", Data: SessionReplaced{}},
+	{Type: "kicked", Description: "A teacher removed the student from the class; don't reconnect", Data: Kicked{}},
+	{Type: "student_command", Description: "A teacher command, sent to the extension without a type field", Data: StudentCommand{}, Whole: true},
+	{Type: "teacher_registered", Description: "Confirms teacher_connect", Data: TeacherRegistered{}},
+	{Type: "session_displaced", Description: "Another teacher took over the class", Data: SessionDisplaced{}},
+	{Type: "staff_joined", Description: "A dashboard joined the class", Data: StaffMember{}},
+	{Type: "staff_left", Description: "A dashboard left the class", Data: StaffMember{}},
+	{Type: "staff_role_changed", Description: "A dashboard's role changed", Data: StaffMember{}},
+	{Type: "initial_student_list", Description: "The class roster, sent on registration and after missed roster updates", Data: []RosterEntry{}},
+	{Type: "student_connected", Description: "A student joined the class", Data: StudentConnected{}},
+	{Type: "student_disconnected", Description: "A student left the class", Data: StudentDisconnected{}},
+	{Type: "student_duplicate", Description: "A duplicate clientId was handled", Data: StudentDuplicate{}},
+	{Type: "student_presence", Description: "A student's presence changed", Data: StudentPresence{}},
+	{Type: "student_resync", Description: "Current state of a student after missed messages", Data: StudentResync{}},
+	{Type: "student_tabs_update", Description: "Relayed tabs_update", Data: StudentEvent{}},
+	{Type: "student_tab_created", Description: "Relayed tab_created", Data: StudentEvent{}},
+	{Type: "student_tab_updated", Description: "Relayed tab_updated", Data: StudentEvent{}},
+	{Type: "student_tab_removed", Description: "Relayed tab_removed", Data: StudentEvent{}},
+	{Type: "student_screenshot", Description: "Relayed screenshot, for dashboards without binary frames", Data: StudentEvent{}},
+	{Type: "student_screenshot_error", Description: "Relayed screenshot_error", Data: StudentEvent{}},
+	{Type: "student_screenshot_skipped", Description: "Relayed screenshot_skipped", Data: StudentEvent{}},
+	{Type: "command_status", Description: "Progress of a command, for dashboards with acks", Data: CommandStatus{}},
+	{Type: "command_failed", Description: "A command failed, for dashboards without acks", Data: CommandFailed{}},
+}
@@ -0,0 +1,130 @@
+package models
+
+import "fmt"
+
+// Protocol versions. Version 1 is the original protocol spoken by extensions
+// that never send hello; anything newer is agreed on in the hello exchange.
+const (
+	ProtocolLegacy = 1
+	ProtocolV2     = 2
+
+	MinProtocol = ProtocolLegacy
+	MaxProtocol = ProtocolV2
+)
+
+// Optional features a client can ask for in hello
+const (
+	CapCompression = "compression" // permessage-deflate on server writes
+	CapBinary      = "binary"      // Screenshots as binary frames (frame.go)
+	CapAcks        = "acks"        // Commands carry a commandId; command_ack/command_result/command_status
+	CapSeq         = "seq"         // Control messages carry "seq"; gaps are followed by a resync
+)
+
+// Close code for clients we cannot speak to
+const CloseUnsupportedProtocol = 4004
+
+// Subprotocol returns the Sec-WebSocket-Protocol name for a version
+func Subprotocol(version int) string {
+	return fmt.Sprintf("saber.v%d", version)
+}
+
+// ProtocolFromSubprotocol maps a negotiated Sec-WebSocket-Protocol back to a
+// version (0 if it isn't one of ours)
+func ProtocolFromSubprotocol(name string) int {
+	for v := MaxProtocol; v >= MinProtocol; v-- {
+		if name == Subprotocol(v) {
+			return v
+		}
+	}
+	return 0
+}
+
+// SetProtocol records the negotiated version and capabilities. A nil caps
+// only pins the version (Sec-WebSocket-Protocol) and still expects a hello.
+func (c *Client) SetProtocol(version int, caps []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protocolVersion = version
+	if caps == nil {
+		return
+	}
+	c.capabilities = make(map[string]bool, len(caps))
+	for _, name := range caps {
+		c.capabilities[name] = true
+	}
+}
+
+// ProtocolVersion returns the negotiated version; clients that never said
+// hello speak the legacy protocol.
+func (c *Client) ProtocolVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.protocolVersion == 0 {
+		return ProtocolLegacy
+	}
+	return c.protocolVersion
+}
+
+// HasCapability reports whether a capability was agreed on in hello
+func (c *Client) HasCapability(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities[name]
+}
+
+// Negotiated reports whether the client has completed the hello exchange
+func (c *Client) Negotiated() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities != nil
+}
+
+// Wire codecs. Text frames are always JSON; after a client negotiates
+// msgpack or CBOR, binary frames carry that codec (or a screenshot frame).
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecCBOR    = "cbor"
+)
+
+// SetCodec records the codec negotiated in hello
+func (c *Client) SetCodec(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = name
+}
+
+// Codec returns the negotiated codec (JSON unless agreed otherwise)
+func (c *Client) Codec() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.codec == "" {
+		return CodecJSON
+	}
+	return c.codec
+}
+
+// Framing modes for batches of queued messages. A frame carrying a single
+// message is always just that message, whatever the mode.
+const (
+	FramingNewline        = "newline"         // Legacy: JSON joined with '\n' in one text frame
+	FramingArray          = "array"           // An array in the connection's codec
+	FramingLengthPrefixed = "length_prefixed" // A binary FrameBatch (frame.go)
+)
+
+// SetFraming records the framing mode negotiated in hello
+func (c *Client) SetFraming(mode string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.framing = mode
+}
+
+// Framing returns the negotiated framing mode (newline unless agreed otherwise)
+func (c *Client) Framing() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.framing == "" {
+		return FramingNewline
+	}
+	return c.framing
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Clients on the "seq" capability get a per-connection sequence number in
+// every control message ({"seq": n, ...}). Numbers are assigned when the hub
+// queues a message, so a message dropped under backpressure leaves a gap the
+// client can see. For dashboards the hub remembers which student each
+// dropped message was about and follows up with a resync snapshot. Students
+// have nothing to resync (their control stream is commands), so their drops
+// only show up as the gap. Lossy streams (screenshots) go through TrySend and
+// are never numbered.
+
+// TrySendControl queues a control message, numbering it for clients on the
+// seq capability. Like TrySend it never blocks.
+func (c *Client) TrySendControl(msg []byte) bool {
+	if !c.HasCapability(CapSeq) || len(msg) < 2 || msg[0] != '{' {
+		return c.TrySend(msg)
+	}
+
+	// Nothing clears drops recorded for a student, so don't keep them
+	track := c.GetClientType() != "student"
+
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	c.seq++
+	stamped := stampSeq(msg, c.seq)
+	if c.TrySend(stamped) {
+		return true
+	}
+	if !track {
+		return false
+	}
+	if c.dropped == nil {
+		c.dropped = make(map[string][]uint64)
+	}
+	subject := messageSubject(msg)
+	c.dropped[subject] = append(c.dropped[subject], c.seq)
+	return false
+}
+
+// HasDropped reports whether numbered messages were dropped since the last
+// TakeDropped
+func (c *Client) HasDropped() bool {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	return len(c.dropped) > 0
+}
+
+// TakeDropped returns and clears the dropped sequence numbers, keyed by the
+// clientId of the student each message was about ("" when it wasn't about
+// one student)
+func (c *Client) TakeDropped() map[string][]uint64 {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	dropped := c.dropped
+	c.dropped = nil
+	return dropped
+}
+
+// RestoreDropped puts back sequence numbers taken by TakeDropped whose
+// resync could not be queued either, so the next resync still covers them
+func (c *Client) RestoreDropped(subject string, seqs []uint64) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	if c.dropped == nil {
+		c.dropped = make(map[string][]uint64)
+	}
+	c.dropped[subject] = append(append([]uint64{}, seqs...), c.dropped[subject]...)
+}
+
+// SeqRanges compresses sorted sequence numbers into [from, to] ranges
+func SeqRanges(seqs []uint64) [][2]uint64 {
+	ranges := [][2]uint64{}
+	for _, seq := range seqs {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == seq {
+			ranges[n-1][1] = seq
+			continue
+		}
+		ranges = append(ranges, [2]uint64{seq, seq})
+	}
+	return ranges
+}
+
+// stampSeq splices "seq" in as the first field of a JSON object
+func stampSeq(msg []byte, seq uint64) []byte {
+	stamped := make([]byte, 0, len(msg)+24)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	if len(msg) > 2 && msg[1] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, msg[1:]...)
+}
+
+// messageSubject extracts data.clientId, which every student_* message carries
+func messageSubject(msg []byte) string {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(msg, &envelope) != nil || len(envelope.Data) == 0 || envelope.Data[0] != '{' {
+		return ""
+	}
+	var data struct {
+		ClientID string `json:"clientId"`
+	}
+	json.Unmarshal(envelope.Data, &data)
+	return data.ClientID
+}
@@ -0,0 +1,107 @@
+package models
+
+import "fmt"
+
+// Every connection moves forward through these states, never back:
+//
+//	upgraded    socket open, waiting for student_connect or teacher_connect
+//	identified  a connect message was accepted; the hub is placing the client
+//	registered  the hub admitted it to a class
+//	closing     on its way out, whatever the reason
+//
+// A connection that stays upgraded past the identify deadline is closed, and
+// one that has identified can't connect again, as the same role or another.
+type ConnState int
+
+const (
+	StateUpgraded ConnState = iota
+	StateIdentified
+	StateRegistered
+	StateClosing
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateUpgraded:
+		return "upgraded"
+	case StateIdentified:
+		return "identified"
+	case StateRegistered:
+		return "registered"
+	case StateClosing:
+		return "closing"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// State returns where the connection is in its lifecycle
+func (c *Client) State() ConnState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// Identify claims an upgraded connection for a role and clientId. It fails
+// once the connection has identified, so roles can't be switched mid-session.
+func (c *Client) Identify(clientType, clientID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case StateUpgraded:
+		c.state = StateIdentified
+		c.clientType = clientType
+		c.clientID = clientID
+		return nil
+	case StateClosing:
+		return fmt.Errorf("connection is closing")
+	}
+	return fmt.Errorf("already connected as %s", c.clientType)
+}
+
+// MarkRegistered records that the hub admitted the client. A connection that
+// started closing in the meantime stays closing.
+func (c *Client) MarkRegistered() {
+	c.advance(StateRegistered)
+}
+
+// ExpireUnidentified moves a connection that never identified to closing,
+// reporting whether it did. The caller closes it.
+func (c *Client) ExpireUnidentified() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != StateUpgraded {
+		return false
+	}
+	c.state = StateClosing
+	return true
+}
+
+func (c *Client) advance(to ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if to > c.state {
+		c.state = to
+	}
+}
+
+// GetClientID returns the clientId, as the hub may have amended it (see SetClientID)
+func (c *Client) GetClientID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientID
+}
+
+// SetClientID lets the hub move a student to another slot ID on resume or
+// under the multi duplicate policy
+func (c *Client) SetClientID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clientID = id
+}
+
+// GetClientType returns "student", "teacher", or "" before identification
+func (c *Client) GetClientType() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientType
+}
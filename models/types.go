@@ -14,19 +14,89 @@ type Client struct {
 	Conn       *websocket.Conn
 	// Buffered channel for outbound messages
 	Send       chan []byte
-	ClientID   string
-	ClientType string // "student" or "teacher"
+	// Closed by the writePump once it has flushed and exited
+	WriteDone  chan struct{}
+	// Set by Identify; read through GetClientID/GetClientType (state.go)
+	clientID   string
+	clientType string // "student" or "teacher"
+	state      ConnState
+	ClassCode  string // Class the client joined; scopes all routing
+	role       string // Staff role within the class (teachers only)
+	// Role granted by the teacher token; the hub may demote an owner to
+	// observer under the takeover policy. Set before Register, then read-only.
+	RequestedRole string
 	Email      string
+	// Origin header of the upgrade request; empty for non-browser clients
+	Origin     string
+	// Source address, taken from X-Forwarded-For behind a trusted proxy
+	RemoteIP   string
+	ConnectedAt time.Time
 	LastSeen   time.Time
+	// User activity as opposed to any traffic: tab events and extension
+	// activity hints (chrome.idle state: "active", "idle" or "locked")
+	lastActivity time.Time
+	activityHint string
+	// Issued by the hub on register; the extension presents it back in
+	// student_connect to reclaim its slot after a brief disconnect
+	ResumeToken string
 	
+	// Agreed on in the hello exchange (see protocol.go)
+	protocolVersion int
+	capabilities    map[string]bool
+	codec           string
+	framing         string
+
 	// Added back to fix "unknown field" error
-	CurrentTabs map[string]interface{}
+	CurrentTabs map[string]json.RawMessage
 
 	// We use a RWMutex specifically for client state to allow 
 	// high-speed concurrent reads of client status
 	mu         sync.RWMutex
+
+	// Guards Send against being closed while a fast-path sender is writing to it
+	sendMu     sync.RWMutex
+	closed     bool
+	// Close frame the writePump sends once Send is closed
+	closeCode   int
+	closeReason string
+
+	// Control stream numbering (see sequence.go)
+	seqMu   sync.Mutex
+	seq     uint64
+	dropped map[string][]uint64
+}
+
+// Staff roles within a class
+const (
+	RoleOwner     = "owner"      // Controls the class; at most one per class
+	RoleCoTeacher = "co_teacher" // May send teacher_command alongside the owner
+	RoleObserver  = "observer"   // Receives the student relay stream only
+)
+
+// ValidRole reports whether a role name is known
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleCoTeacher || role == RoleObserver
+}
+
+// CanCommand reports whether a staff role may send teacher_command
+func CanCommand(role string) bool {
+	return role == RoleOwner || role == RoleCoTeacher
 }
 
+// Application close codes (RFC 6455 reserves 4000-4999 for applications)
+const (
+	CloseSessionReplaced = 4000 // Another connection took over this clientId
+	CloseTeacherTakeover = 4001 // Another teacher took over the class
+	CloseRejected        = 4002 // Connection refused by a takeover/duplicate policy
+	CloseClassFull       = 4003 // Class reached MaxStudents
+	CloseOriginRejected  = 4005 // Origin not allowed for the role it connected as
+	CloseRateLimited     = 4006 // Kept sending over its rate limits after a warning
+	CloseIdentifyTimeout = 4007 // No student_connect/teacher_connect within the deadline
+	CloseKicked          = 4008 // A teacher removed the student from the class
+
+	CloseServerShutdown = 1001 // Going away: reconnect after the server_shutdown hint
+)
+
 // Hub maintains active clients and broadcasts messages
 type Hub struct {
 	Students   map[string]*Client
@@ -45,31 +115,130 @@ type Hub struct {
 
 // BroadcastMessage wraps a message with its target
 type BroadcastMessage struct {
-	Target  string // "teacher", "student", or specific clientID
-	Message []byte
+	ClassCode string // Class the message is scoped to
+	Target    string // "teacher", "student", or specific clientID
+	Message   []byte
 }
 
-// Message represents the base WebSocket message structure
-type Message struct {
-	Type string                 `json:"type"`
-	Data map[string]interface{} `json:"data,omitempty"`
+// Broadcast targets
+const (
+	TargetStaff    = "teacher" // Every staff member, observers included
+	TargetStudents = "student" // Every student in the class
+)
+
+// RawMessage is the envelope every inbound message shares. Data stays
+// encoded until the handler decodes it into its typed struct (messages.go),
+// so relays can splice the payload into the outgoing message untouched.
+type RawMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
 }
 
 // --- Helper Methods ---
 
+// TrySend queues a message without blocking. It returns false if the buffer
+// is full or the connection has already been closed by the hub.
+func (c *Client) TrySend(msg []byte) bool {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.Send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the Send channel exactly once, which makes the writePump
+// send a close frame and exit.
+func (c *Client) Close() {
+	c.CloseWith(0, "")
+}
+
+// CloseWith is Close with an explicit close code and reason for the close frame
+func (c *Client) CloseWith(code int, reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.closed {
+		c.advance(StateClosing)
+		c.closed = true
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.Send)
+	}
+}
+
+// CloseInfo returns the close code and reason set by CloseWith (0 if none)
+func (c *Client) CloseInfo() (int, string) {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+	return c.closeCode, c.closeReason
+}
+
+func (c *Client) SetRole(role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+func (c *Client) GetRole() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.role
+}
+
 func (c *Client) UpdateLastSeen() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.LastSeen = time.Now()
 }
 
+// MarkActivity records user-driven activity (e.g. a tab event)
+func (c *Client) MarkActivity() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastActivity = time.Now()
+}
+
+// SetActivityHint records the extension's own idle detection result
+func (c *Client) SetActivityHint(state string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activityHint = state
+	if at.After(c.lastActivity) {
+		c.lastActivity = at
+	}
+}
+
+// PresenceSnapshot returns the inputs the hub classifies presence from.
+// Until the first activity, the connect time stands in for it.
+func (c *Client) PresenceSnapshot() (lastSeen, lastActivity time.Time, hint string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	lastActivity = c.lastActivity
+	if lastActivity.IsZero() {
+		lastActivity = c.ConnectedAt
+	}
+	return c.LastSeen, lastActivity, c.activityHint
+}
+
 // Helper to safely set tabs (Thread-safe)
-func (c *Client) SetCurrentTabs(tabs map[string]interface{}) {
+func (c *Client) SetCurrentTabs(tabs map[string]json.RawMessage) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.CurrentTabs = tabs
 }
 
+// Helper to safely read tabs (Thread-safe)
+func (c *Client) GetCurrentTabs() map[string]json.RawMessage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.CurrentTabs
+}
+
 func (c *Client) MarshalJSON() ([]byte, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -78,7 +247,7 @@ func (c *Client) MarshalJSON() ([]byte, error) {
 		Email    string    `json:"email"`
 		LastSeen time.Time `json:"lastSeen"`
 	}{
-		ClientID: c.ClientID,
+		ClientID: c.clientID,
 		Email:    c.Email,
 		LastSeen: c.LastSeen,
 	})
@@ -0,0 +1,324 @@
+// Package policy decides which teacher commands are relayed to students.
+// A policy file lists every command the server knows, the arguments each
+// takes, which staff roles may send it, and optional per-class restrictions:
+//
+//	{
+//	  "commands": {
+//	    "open_tab": {
+//	      "description": "Open a URL in a new tab",
+//	      "roles": ["owner", "co_teacher"],
+//	      "args": {
+//	        "url": {"type": "string", "validate": "required,max=2048", "pattern": "^https?://"}
+//	      }
+//	    },
+//	    "close_all_tabs": {"roles": ["owner"]},
+//	    "lock_screen": {"args": {"message": {"type": "string", "validate": "max=200"}}}
+//	  },
+//	  "classes": {
+//	    "exam-*": {"deny": ["open_tab"]},
+//	    "lab-101": {"allow": ["lock_screen"]}
+//	  }
+//	}
+//
+// Commands not listed are refused. Roles default to every role that may send
+// commands at all. Without "args" the command's data is passed through
+// unchecked; with it, data must be an object holding only the listed
+// arguments. Each argument has a JSON type (string, number, integer, boolean,
+// object or array), optional rules in the schema package's validate syntax,
+// and for strings an optional regular expression.
+//
+// Class entries match a class code exactly, or by prefix when they end in
+// "*". Every matching entry applies: a command must be in each "allow" list
+// and in no "deny" list.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"saber-websocket/models"
+	"saber-websocket/schema"
+	"sort"
+	"strings"
+)
+
+// Reasons a command is refused, as reported to the dashboard
+const (
+	ReasonUnknownCommand  = "unknown_command"
+	ReasonRoleNotAllowed  = "role_not_allowed"
+	ReasonClassRestricted = "class_restricted"
+	ReasonInvalidArgs     = "invalid_args"
+)
+
+// Policy is a loaded policy file. A nil *Policy allows every command.
+type Policy struct {
+	Commands map[string]*Command     `json:"commands"`
+	Classes  map[string]*ClassPolicy `json:"classes,omitempty"`
+}
+
+// Command describes one command dashboards may send
+type Command struct {
+	Description string          `json:"description,omitempty"`
+	Roles       []string        `json:"roles,omitempty"`
+	Args        map[string]*Arg `json:"args,omitempty"`
+}
+
+// Arg describes one field of a command's data
+type Arg struct {
+	Type     string `json:"type"`
+	Validate string `json:"validate,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// ClassPolicy narrows the commands available in matching classes
+type ClassPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Denial says why a command was refused
+type Denial struct {
+	Reason  string
+	Message string
+	Field   string // Set for invalid_args
+	Rule    string
+}
+
+func (d *Denial) Error() string {
+	return d.Message
+}
+
+// Load reads and checks a policy file. Unknown keys are errors, so a typo
+// can't quietly loosen the policy.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var p Policy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Allowlist builds a policy from a plain list of command names, each
+// available to every commanding role with its data passed through unchecked
+func Allowlist(names []string) (*Policy, error) {
+	p := &Policy{Commands: make(map[string]*Command, len(names))}
+	for _, name := range names {
+		p.Commands[name] = &Command{}
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check validates the policy and compiles its patterns
+func (p *Policy) check() error {
+	if len(p.Commands) == 0 {
+		return fmt.Errorf("no commands defined")
+	}
+	for name, cmd := range p.Commands {
+		if cmd == nil {
+			return fmt.Errorf("command %s: empty definition", name)
+		}
+		if !schema.Formats["command"].MatchString(name) {
+			return fmt.Errorf("command %s: not a valid command name", name)
+		}
+		for _, role := range cmd.Roles {
+			if !models.ValidRole(role) {
+				return fmt.Errorf("command %s: unknown role %q", name, role)
+			}
+			if !models.CanCommand(role) {
+				return fmt.Errorf("command %s: %ss can't send commands", name, role)
+			}
+		}
+		for argName, arg := range cmd.Args {
+			if err := arg.compile(); err != nil {
+				return fmt.Errorf("command %s: arg %s: %w", name, argName, err)
+			}
+		}
+	}
+	for code, class := range p.Classes {
+		if class == nil {
+			return fmt.Errorf("class %s: empty definition", code)
+		}
+		for _, name := range append(append([]string{}, class.Allow...), class.Deny...) {
+			if _, ok := p.Commands[name]; !ok {
+				return fmt.Errorf("class %s: unknown command %s", code, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Arg) compile() error {
+	if a == nil {
+		return fmt.Errorf("empty definition")
+	}
+	switch a.Type {
+	case "string", "number", "integer", "boolean", "object", "array":
+	default:
+		return fmt.Errorf("unknown type %q", a.Type)
+	}
+	if err := schema.CheckRuleSyntax(a.Validate); err != nil {
+		return err
+	}
+	if a.Pattern != "" {
+		if a.Type != "string" {
+			return fmt.Errorf("pattern only applies to strings")
+		}
+		re, err := regexp.Compile(a.Pattern)
+		if err != nil {
+			return err
+		}
+		a.pattern = re
+	}
+	return nil
+}
+
+// Authorize decides whether a staff member with role may send command with
+// data to a student in classCode
+func (p *Policy) Authorize(classCode, role, command string, data json.RawMessage) *Denial {
+	if p == nil {
+		return nil
+	}
+	cmd, ok := p.Commands[command]
+	if !ok {
+		return &Denial{Reason: ReasonUnknownCommand, Message: "Unknown command: " + command}
+	}
+	if len(cmd.Roles) > 0 && !contains(cmd.Roles, role) {
+		return &Denial{
+			Reason:  ReasonRoleNotAllowed,
+			Message: fmt.Sprintf("%s is limited to %s", command, strings.Join(cmd.Roles, ", ")),
+		}
+	}
+	for _, pattern := range p.classPatterns(classCode) {
+		class := p.Classes[pattern]
+		if (len(class.Allow) > 0 && !contains(class.Allow, command)) || contains(class.Deny, command) {
+			return &Denial{
+				Reason:  ReasonClassRestricted,
+				Message: fmt.Sprintf("%s is not available in class %s", command, classCode),
+			}
+		}
+	}
+	if cmd.Args != nil {
+		if err := checkArgs(cmd.Args, data); err != nil {
+			d := &Denial{Reason: ReasonInvalidArgs, Message: err.Error()}
+			if fieldErr, ok := err.(*schema.FieldError); ok {
+				d.Field, d.Rule = fieldErr.Field, fieldErr.Rule
+			}
+			return d
+		}
+	}
+	return nil
+}
+
+// classPatterns returns the class entries that apply to a class code, in a
+// fixed order so the same command is always refused for the same reason
+func (p *Policy) classPatterns(classCode string) []string {
+	var matched []string
+	for pattern := range p.Classes {
+		if pattern == classCode ||
+			(strings.HasSuffix(pattern, "*") && strings.HasPrefix(classCode, strings.TrimSuffix(pattern, "*"))) {
+			matched = append(matched, pattern)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// checkArgs validates command data against its argument definitions
+func checkArgs(args map[string]*Arg, data json.RawMessage) error {
+	values := map[string]interface{}{}
+	if len(data) > 0 && !bytes.Equal(data, []byte("null")) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return &schema.FieldError{Field: "data.data", Rule: "type", Message: "must be an object"}
+		}
+	}
+
+	for name := range values {
+		if _, ok := args[name]; !ok {
+			return &schema.FieldError{Field: "data.data." + name, Rule: "unknown", Message: "is not an argument of this command"}
+		}
+	}
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := args[name].check(values[name], "data.data."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Arg) check(v interface{}, path string) error {
+	if v != nil && !hasType(v, a.Type) {
+		return &schema.FieldError{Field: path, Rule: "type", Message: "must be " + article(a.Type)}
+	}
+	// Rules compare numbers as float64, like the struct-tag ones
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		v = f
+	}
+	if err := schema.CheckValue(v, path, a.Validate); err != nil {
+		return err
+	}
+	if s, ok := v.(string); ok && a.pattern != nil && !a.pattern.MatchString(s) {
+		return &schema.FieldError{Field: path, Rule: "pattern", Message: "does not match " + a.Pattern}
+	}
+	return nil
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch v := v.(type) {
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number:
+		if typ == "integer" {
+			_, err := v.Int64()
+			return err == nil
+		}
+		return typ == "number"
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	}
+	return false
+}
+
+func article(typ string) string {
+	switch typ {
+	case "integer", "object", "array":
+		return "an " + typ
+	}
+	return "a " + typ
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+  "commands": {
+    "open_tab": {
+      "roles": ["owner", "co_teacher"],
+      "args": {"url": {"type": "string", "validate": "required,max=64", "pattern": "^https?://"}}
+    },
+    "close_all_tabs": {"roles": ["owner"]},
+    "lock_screen": {"args": {"message": {"type": "string", "validate": "max=20"}}},
+    "ping_student": {}
+  },
+  "classes": {
+    "exam-*": {"deny": ["open_tab"]},
+    "exam-final": {"allow": ["lock_screen", "close_all_tabs"]},
+    "lab-101": {"allow": ["lock_screen"]}
+  }
+}`
+
+func writePolicy(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthorize(t *testing.T) {
+	p, err := Load(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name                 string
+		class, role, command string
+		data                 string
+		reason, field        string
+	}{
+		{"allowed", "C1", "owner", "open_tab", `{"url":"https://example.com"}`, "", ""},
+		{"co-teacher allowed", "C1", "co_teacher", "open_tab", `{"url":"https://example.com"}`, "", ""},
+		{"no roles means any commanding role", "C1", "co_teacher", "ping_student", `{"anything":[1]}`, "", ""},
+
+		// Deny by default
+		{"unknown command", "C1", "owner", "format_disk", `{}`, ReasonUnknownCommand, ""},
+		{"command names are exact", "C1", "owner", "Open_Tab", `{}`, ReasonUnknownCommand, ""},
+		{"role not listed", "C1", "co_teacher", "close_all_tabs", ``, ReasonRoleNotAllowed, ""},
+		{"observer", "C1", "observer", "open_tab", `{"url":"https://example.com"}`, ReasonRoleNotAllowed, ""},
+		{"no role", "C1", "", "open_tab", `{"url":"https://example.com"}`, ReasonRoleNotAllowed, ""},
+
+		// Per-class overrides
+		{"prefix deny", "exam-1", "owner", "open_tab", `{"url":"https://example.com"}`, ReasonClassRestricted, ""},
+		{"prefix deny, other command", "exam-1", "owner", "lock_screen", `{}`, "", ""},
+		{"exact allow", "lab-101", "owner", "lock_screen", `{}`, "", ""},
+		{"exact allow excludes the rest", "lab-101", "owner", "close_all_tabs", ``, ReasonClassRestricted, ""},
+		{"exact entry is not a prefix", "lab-1010", "owner", "close_all_tabs", ``, "", ""},
+		{"every matching entry applies", "exam-final", "owner", "close_all_tabs", ``, "", ""},
+		{"every matching entry applies, deny wins", "exam-final", "owner", "open_tab", `{"url":"https://example.com"}`, ReasonClassRestricted, ""},
+		{"role checked before class", "lab-101", "co_teacher", "close_all_tabs", ``, ReasonRoleNotAllowed, ""},
+
+		// Arguments
+		{"missing required arg", "C1", "owner", "open_tab", `{}`, ReasonInvalidArgs, "data.data.url"},
+		{"pattern", "C1", "owner", "open_tab", `{"url":"javascript:alert(1)"}`, ReasonInvalidArgs, "data.data.url"},
+		{"wrong type", "C1", "owner", "open_tab", `{"url":7}`, ReasonInvalidArgs, "data.data.url"},
+		{"unknown arg", "C1", "owner", "lock_screen", `{"message":"hi","extra":1}`, ReasonInvalidArgs, "data.data.extra"},
+		{"arg too long", "C1", "owner", "lock_screen", `{"message":"` + strings.Repeat("x", 21) + `"}`, ReasonInvalidArgs, "data.data.message"},
+		{"data not an object", "C1", "owner", "lock_screen", `["hi"]`, ReasonInvalidArgs, "data.data"},
+		{"null data", "C1", "owner", "lock_screen", `null`, "", ""},
+	}
+	for _, c := range cases {
+		d := p.Authorize(c.class, c.role, c.command, json.RawMessage(c.data))
+		switch {
+		case c.reason == "" && d != nil:
+			t.Errorf("%s: denied (%s: %s), want allowed", c.name, d.Reason, d.Message)
+		case c.reason != "" && d == nil:
+			t.Errorf("%s: allowed, want %s", c.name, c.reason)
+		case d != nil && (d.Reason != c.reason || d.Field != c.field):
+			t.Errorf("%s: denied with %s (field %q), want %s (field %q)", c.name, d.Reason, d.Field, c.reason, c.field)
+		}
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var p *Policy
+	if d := p.Authorize("C1", "observer", "anything", nil); d != nil {
+		t.Errorf("nil policy denied: %v", d)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []struct {
+		name, body, want string
+	}{
+		{"not JSON", `{"commands":`, "unexpected EOF"},
+		{"unknown key", `{"commands":{"lock_screen":{}},"clases":{}}`, `unknown field "clases"`},
+		{"unknown command key", `{"commands":{"lock_screen":{"role":["owner"]}}}`, `unknown field "role"`},
+		{"no commands", `{"commands":{}}`, "no commands defined"},
+		{"null command", `{"commands":{"lock_screen":null}}`, "command lock_screen: empty definition"},
+		{"bad command name", `{"commands":{"lock screen":{}}}`, "not a valid command name"},
+		{"unknown role", `{"commands":{"lock_screen":{"roles":["principal"]}}}`, `unknown role "principal"`},
+		{"observer role", `{"commands":{"lock_screen":{"roles":["observer"]}}}`, "observers can't send commands"},
+		{"unknown arg type", `{"commands":{"open_tab":{"args":{"url":{"type":"url"}}}}}`, `unknown type "url"`},
+		{"bad rule", `{"commands":{"open_tab":{"args":{"url":{"type":"string","validate":"maxx=3"}}}}}`, `unknown rule "maxx"`},
+		{"bad pattern", `{"commands":{"open_tab":{"args":{"url":{"type":"string","pattern":"("}}}}}`, "error parsing regexp"},
+		{"pattern on a number", `{"commands":{"zoom":{"args":{"level":{"type":"number","pattern":"^1"}}}}}`, "pattern only applies to strings"},
+		{"class names unknown command", `{"commands":{"lock_screen":{}},"classes":{"C1":{"deny":["open_tab"]}}}`, "class C1: unknown command open_tab"},
+		{"null class", `{"commands":{"lock_screen":{}},"classes":{"C1":null}}`, "class C1: empty definition"},
+	}
+	for _, c := range cases {
+		p, err := Load(writePolicy(t, c.body))
+		if err == nil {
+			t.Errorf("%s: loaded %+v, want an error", c.name, p)
+		} else if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v, want %q", c.name, err, c.want)
+		}
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v, want not-exist", err)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	p, err := Allowlist([]string{"lock_screen", "open_tab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := p.Authorize("C1", "co_teacher", "open_tab", json.RawMessage(`{"url":1}`)); d != nil {
+		t.Errorf("listed command denied: %v", d)
+	}
+	if d := p.Authorize("C1", "owner", "close_all_tabs", nil); d == nil || d.Reason != ReasonUnknownCommand {
+		t.Errorf("unlisted command: got %v, want %s", d, ReasonUnknownCommand)
+	}
+	for _, names := range [][]string{nil, {"bad name"}} {
+		if _, err := Allowlist(names); err == nil {
+			t.Errorf("Allowlist(%q) succeeded", names)
+		}
+	}
+}
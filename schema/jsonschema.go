@@ -0,0 +1,151 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Draft the generated documents declare
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schemer lets a type describe itself when reflection can't, e.g. a type
+// with a custom UnmarshalJSON
+type Schemer interface {
+	JSONSchema() map[string]interface{}
+}
+
+var (
+	schemerType    = reflect.TypeOf((*Schemer)(nil)).Elem()
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// Message returns the schema of a standard message: the "type"
+// discriminator plus data described by v (nil for messages without data)
+func Message(msgType, description string, data interface{}) map[string]interface{} {
+	properties := map[string]interface{}{
+		"type": map[string]interface{}{"const": msgType},
+	}
+	required := []string{"type"}
+	if data != nil {
+		properties["data"] = Generate(data)
+		required = append(required, "data")
+	}
+	return map[string]interface{}{
+		"$schema":     Draft,
+		"title":       msgType,
+		"description": description,
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	}
+}
+
+// Document returns the schema of a message that doesn't follow the
+// {type, data} shape, described entirely by v
+func Document(title, description string, v interface{}) map[string]interface{} {
+	doc := Generate(v)
+	doc["$schema"] = Draft
+	doc["title"] = title
+	doc["description"] = description
+	return doc
+}
+
+// Generate describes a Go value's JSON encoding, applying the validate tags
+func Generate(v interface{}) map[string]interface{} {
+	return describe(reflect.TypeOf(v))
+}
+
+func describe(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	if t.Implements(schemerType) {
+		return reflect.Zero(t).Interface().(Schemer).JSONSchema()
+	}
+	if t.Kind() == reflect.Ptr {
+		return describe(t.Elem())
+	}
+	if t == rawMessageType {
+		return map[string]interface{}{} // Anything
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": describe(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": describe(t.Elem())}
+	case reflect.Struct:
+		return describeStruct(t)
+	}
+	return map[string]interface{}{}
+}
+
+func describeStruct(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		prop := describe(field.Type)
+		if desc := field.Tag.Get("desc"); desc != "" {
+			prop["description"] = desc
+		}
+		for _, r := range parseRules(field.Tag.Get("validate")) {
+			if r.name == "required" {
+				required = append(required, name)
+				continue
+			}
+			applyRule(prop, r)
+		}
+		properties[name] = prop
+	}
+
+	doc := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		doc["required"] = required
+	}
+	return doc
+}
+
+// applyRule maps a validate rule onto the matching JSON Schema keyword
+func applyRule(prop map[string]interface{}, r rule) {
+	keyword := map[string]map[string]string{
+		"string":  {"min": "minLength", "max": "maxLength"},
+		"array":   {"min": "minItems", "max": "maxItems"},
+		"object":  {"min": "minProperties", "max": "maxProperties"},
+		"integer": {"min": "minimum", "max": "maximum"},
+		"number":  {"min": "minimum", "max": "maximum"},
+	}
+	kind, _ := prop["type"].(string)
+
+	switch r.name {
+	case "min", "max":
+		if name, ok := keyword[kind][r.name]; ok {
+			n, _ := strconv.ParseFloat(r.arg, 64)
+			prop[name] = n
+		}
+	case "oneof":
+		prop["enum"] = strings.Fields(r.arg)
+	case "format":
+		if pattern, ok := Formats[r.arg]; ok {
+			prop["pattern"] = pattern.String()
+		}
+	}
+}
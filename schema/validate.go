@@ -0,0 +1,258 @@
+// Package schema validates protocol messages against the rules in their
+// struct tags and generates JSON Schema documents from the same tags, so the
+// server and the extension team work from one definition.
+//
+// Rules live in a `validate` tag, comma separated:
+//
+//	required        must be present and non-zero; "" counts as missing, {} and [] don't
+//	min=N, max=N    string length in bytes, item count, or numeric bounds
+//	oneof=a b c     string must be one of the listed values
+//	format=name     string must match a named format (see Formats)
+//
+// Types that need more than tags implement Validator; it runs on values
+// that are present. An optional `desc` tag becomes the field's description
+// in the schema.
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formats are the named string patterns usable in format= rules. Empty
+// strings are left to the required rule.
+var Formats = map[string]*regexp.Regexp{
+	// Extension-generated identifiers (clientId, commandId, requestId)
+	"id": regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:@-]*$`),
+	// A clientId as the server reports it, possibly with a "#n" device
+	// suffix under the multi duplicate policy
+	"deviceId": regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:@-]*(#[0-9]+)?$`),
+	// Short, URL-safe class identifiers handed out by the teacher
+	"classCode": regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`),
+	// Teacher command names
+	"command": regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`),
+}
+
+// Validator is implemented by field types that check themselves
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes the first rule a message broke
+type FieldError struct {
+	Field   string // JSON path, e.g. "data.clientId"
+	Rule    string // The rule that failed, e.g. "required" or "max"
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Validate checks a struct (or pointer to one) against its validate tags,
+// returning a *FieldError for the first violation
+func Validate(v interface{}) error {
+	return validateValue(reflect.ValueOf(v), "data")
+}
+
+func validateValue(v reflect.Value, path string) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, ok := jsonName(field)
+			if !ok {
+				continue
+			}
+			fieldPath := path + "." + name
+			if err := checkRules(v.Field(i), fieldPath, parseRules(field.Tag.Get("validate"))); err != nil {
+				return err
+			}
+			if err := validateValue(v.Field(i), fieldPath); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil // json.RawMessage and friends
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckValue applies rules written like a validate tag to one decoded JSON
+// value, for rules that come from configuration rather than struct tags.
+// A nil value is missing.
+func CheckValue(v interface{}, path, rules string) error {
+	rv := reflect.ValueOf(&v).Elem()
+	if v != nil {
+		rv = reflect.ValueOf(v)
+	}
+	return checkRules(rv, path, parseRules(rules))
+}
+
+// CheckRuleSyntax reports rules that would make CheckValue panic, so
+// configured rules can be refused when they are loaded
+func CheckRuleSyntax(rules string) error {
+	for _, r := range parseRules(rules) {
+		switch r.name {
+		case "required", "oneof":
+		case "min", "max":
+			if _, err := strconv.ParseFloat(r.arg, 64); err != nil {
+				return fmt.Errorf("%s needs a number, not %q", r.name, r.arg)
+			}
+		case "format":
+			if _, ok := Formats[r.arg]; !ok {
+				return fmt.Errorf("unknown format %q", r.arg)
+			}
+		default:
+			return fmt.Errorf("unknown rule %q", r.name)
+		}
+	}
+	return nil
+}
+
+// rule is one parsed entry of a validate tag
+type rule struct {
+	name string
+	arg  string
+}
+
+func parseRules(tag string) []rule {
+	var rules []rule
+	for _, part := range strings.Split(tag, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(part, "=")
+		rules = append(rules, rule{name: name, arg: arg})
+	}
+	return rules
+}
+
+func checkRules(v reflect.Value, path string, rules []rule) error {
+	fail := func(r rule, format string, args ...interface{}) error {
+		return &FieldError{Field: path, Rule: r.name, Message: fmt.Sprintf(format, args...)}
+	}
+
+	for _, r := range rules {
+		switch r.name {
+		case "required":
+			if v.IsZero() {
+				return fail(r, "is required")
+			}
+		}
+	}
+
+	// The remaining rules only apply to values that are present
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.IsZero() {
+		return nil
+	}
+	if self, ok := v.Interface().(Validator); ok {
+		if err := self.Validate(); err != nil {
+			return &FieldError{Field: path, Rule: "format", Message: err.Error()}
+		}
+	}
+
+	for _, r := range rules {
+		switch r.name {
+		case "min", "max":
+			limit, err := strconv.ParseFloat(r.arg, 64)
+			if err != nil {
+				panic("schema: bad " + r.name + " rule on " + path)
+			}
+			size, unit := measure(v)
+			if r.name == "min" && size < limit {
+				return fail(r, "must be at least %s%s", r.arg, unit)
+			}
+			if r.name == "max" && size > limit {
+				return fail(r, "must be at most %s%s", r.arg, unit)
+			}
+
+		case "oneof":
+			if v.Kind() != reflect.String {
+				continue
+			}
+			allowed := strings.Fields(r.arg)
+			if !contains(allowed, v.String()) {
+				return fail(r, "must be one of %s", strings.Join(allowed, ", "))
+			}
+
+		case "format":
+			pattern, ok := Formats[r.arg]
+			if !ok {
+				panic("schema: unknown format " + r.arg + " on " + path)
+			}
+			if v.Kind() == reflect.String && !pattern.MatchString(v.String()) {
+				return fail(r, "is not a valid %s", r.arg)
+			}
+		}
+	}
+	return nil
+}
+
+// measure returns what min/max compare against and the unit for messages
+func measure(v reflect.Value) (float64, string) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(v.Len()), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	}
+	return 0, ""
+}
+
+// jsonName returns the field's name on the wire, or false for fields that
+// never appear there
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
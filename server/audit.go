@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/audit"
+	"saber-websocket/models"
+)
+
+// Teacher actions are written to the audit log from the room loop, where
+// the outcome is known (the role actually granted, the commandId assigned).
+
+// AttachAuditLog sets the log teacher actions are recorded in. Call it
+// before Run.
+func (h *Hub) AttachAuditLog(l *audit.Log) {
+	h.audit = l
+}
+
+// AuditLog returns the attached log; recording to a nil log does nothing
+func (h *Hub) AuditLog() *audit.Log {
+	return h.audit
+}
+
+// auditTeacher records an event about a staff member of this room
+func (r *Room) auditTeacher(event string, teacher *models.Client, detail string, data interface{}) {
+	if r.hub.audit == nil {
+		return
+	}
+	r.hub.audit.Record(audit.Entry{
+		Event:     event,
+		ClassCode: r.code,
+		TeacherID: teacher.GetClientID(),
+		Role:      teacher.GetRole(),
+		RemoteIP:  teacher.RemoteIP,
+		Detail:    detail,
+		Data:      auditData(data),
+	})
+}
+
+// auditTakeover records a teacher arriving in a class that has an owner. The
+// newcomer has no role yet, so the token's is recorded with the outcome.
+func (r *Room) auditTakeover(newcomer *models.Client, outcome string) {
+	if r.hub.audit == nil {
+		return
+	}
+	r.hub.audit.Record(audit.Entry{
+		Event:     audit.EventTeacherTakeover,
+		ClassCode: r.code,
+		TeacherID: newcomer.GetClientID(),
+		Role:      newcomer.RequestedRole,
+		RemoteIP:  newcomer.RemoteIP,
+		Detail:    outcome,
+		Data:      auditData(map[string]string{"owner": r.teacher.GetClientID()}),
+	})
+}
+
+// auditCommand records a command being sent, or how it ended
+func (r *Room) auditCommand(event string, pc *pendingCommand, detail string, data interface{}) {
+	if r.hub.audit == nil {
+		return
+	}
+	r.hub.audit.Record(audit.Entry{
+		Event:     event,
+		ClassCode: r.code,
+		TeacherID: pc.issuer.GetClientID(),
+		Role:      pc.issuer.GetRole(),
+		StudentID: pc.target,
+		Command:   pc.name,
+		CommandID: pc.id,
+		RequestID: pc.requestID,
+		Detail:    detail,
+		Data:      auditData(data),
+	})
+}
+
+// auditBroadcast records a command sent to every student of the class
+func (r *Room) auditBroadcast(cmd *Command, detail string) {
+	if r.hub.audit == nil {
+		return
+	}
+	r.hub.audit.Record(audit.Entry{
+		Event:     audit.EventBroadcast,
+		ClassCode: r.code,
+		TeacherID: cmd.Issuer.GetClientID(),
+		Role:      cmd.Issuer.GetRole(),
+		StudentID: audit.AllStudents,
+		Command:   cmd.Name,
+		RequestID: cmd.RequestID,
+		Detail:    detail,
+		Data:      auditData(cmd.Data),
+	})
+}
+
+// auditKick records a teacher removing a student, and what came of it
+func (r *Room) auditKick(k *Kick, outcome string) {
+	if r.hub.audit == nil {
+		return
+	}
+	detail := outcome
+	if k.Reason != "" {
+		detail += ": " + k.Reason
+	}
+	r.hub.audit.Record(audit.Entry{
+		Event:     audit.EventKick,
+		ClassCode: r.code,
+		TeacherID: k.Issuer.GetClientID(),
+		Role:      k.Issuer.GetRole(),
+		StudentID: k.Target,
+		RemoteIP:  k.Issuer.RemoteIP,
+		Detail:    detail,
+	})
+}
+
+func auditData(data interface{}) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	if raw, ok := data.(json.RawMessage); ok {
+		return raw
+	}
+	raw, _ := json.Marshal(data)
+	return raw
+}
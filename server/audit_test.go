@@ -0,0 +1,77 @@
+package server
+
+import (
+	"path/filepath"
+	"saber-websocket/audit"
+	"saber-websocket/models"
+	"saber-websocket/utils"
+	"testing"
+)
+
+func TestAuditBroadcastAndKick(t *testing.T) {
+	h := benchHub()
+	l, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"), "test", utils.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h.AttachAuditLog(l)
+	defer shutdown(t, h)
+
+	teacher := benchClient("teacher", "t1", "C1", false)
+	h.Register(teacher)
+	expect(t, teacher, "teacher_registered")
+	s1 := benchClient("student", "s1", "C1", false)
+	s2 := benchClient("student", "s2", "C1", false)
+	for _, s := range []*models.Client{s1, s2} {
+		h.Register(s)
+		expect(t, s, "student_registered")
+	}
+
+	h.SendCommand(&Command{Issuer: teacher, Broadcast: true, Name: "lock_screen", RequestID: "r1"})
+	for _, s := range []*models.Client{s1, s2} {
+		if m := expect(t, s, "lock_screen"); string(m.Data) != "null" {
+			t.Errorf("%s: broadcast data %s", s.GetClientID(), m.Data)
+		}
+	}
+
+	h.Kick(&Kick{Issuer: teacher, Target: "s1", Reason: "off task"})
+	expect(t, s1, "kicked")
+	if code := closeCode(t, s1); code != models.CloseKicked {
+		t.Errorf("kicked student closed with %d, want %d", code, models.CloseKicked)
+	}
+	expect(t, teacher, "student_disconnected")
+
+	h.Kick(&Kick{Issuer: teacher, Target: "nobody"})
+	if m := expect(t, teacher, "error"); m.Code != "not_found" {
+		t.Errorf("kicking an unknown student: error %s, want not_found", m.Code)
+	}
+
+	var entries []*audit.Entry
+	waitFor(t, "audit entries", func() bool {
+		entries, _, _ = l.Query(audit.Filter{ClassCode: "C1", TeacherID: "t1"})
+		return len(entries) >= 4
+	})
+	want := []audit.Entry{
+		{Event: audit.EventTeacherConnected},
+		{Event: audit.EventBroadcast, StudentID: audit.AllStudents, Command: "lock_screen", RequestID: "r1", Detail: "2 of 2 local students, 0 remote"},
+		{Event: audit.EventKick, StudentID: "s1", Detail: "kicked: off task"},
+		{Event: audit.EventKick, StudentID: "nobody", Detail: "not_found"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Event != w.Event || e.StudentID != w.StudentID || e.Command != w.Command ||
+			e.RequestID != w.RequestID || (w.Detail != "" && e.Detail != w.Detail) ||
+			e.ClassCode != "C1" || e.TeacherID != "t1" || e.Role != models.RoleOwner {
+			t.Errorf("entry %d = %+v, want %+v", i, *e, w)
+		}
+	}
+
+	// The kicked student's history shows the broadcast that reached it
+	if entries, _, _ := l.Query(audit.Filter{ClassCode: "C1", StudentID: "s1"}); len(entries) != 2 {
+		t.Errorf("s1's history has %d entries, want the broadcast and the kick", len(entries))
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+)
+
+// AttachBackplane links the hub to other instances. Must be called before Run.
+func (h *Hub) AttachBackplane(bp backplane.Backplane) {
+	h.backplane = bp
+	bp.Subscribe(func(env *backplane.Envelope) {
+		h.remote <- env
+	})
+}
+
+// RelayToRemoteStaff forwards a staff-bound message to dashboards of the class
+// on other instances. Used by the screenshot fast path, which bypasses the room loop.
+func (h *Hub) RelayToRemoteStaff(classCode string, msg []byte) {
+	if h.backplane == nil {
+		return
+	}
+	room := h.room(classCode, false)
+	if room == nil {
+		return
+	}
+	room.mu.RLock()
+	relay := room.hasRemoteAudience(models.TargetStaff)
+	room.mu.RUnlock()
+	if relay {
+		h.publish(&backplane.Envelope{
+			Kind:      backplane.KindStream,
+			ClassCode: classCode,
+			Payload:   msg,
+		})
+	}
+}
+
+func (h *Hub) publish(env *backplane.Envelope) {
+	if h.backplane == nil {
+		return
+	}
+	if err := h.backplane.Publish(env); err != nil {
+		h.logger.Debug(fmt.Sprintf("Backplane publish %s dropped: %v", env.Kind, err))
+	}
+}
+
+// dispatchRemote hands an envelope from another instance to the class loop it
+// concerns. Envelopes without a class go to every room.
+func (h *Hub) dispatchRemote(env *backplane.Envelope) {
+	if env.ClassCode == "" {
+		for _, room := range h.allRooms() {
+			select {
+			case room.remoteIn <- env:
+			case <-room.done:
+			}
+		}
+		return
+	}
+
+	// Only announcements of new members may open a class on this instance
+	create := env.Kind == backplane.KindStudentJoined || (env.Kind == backplane.KindStaffCount && env.Count > 0)
+	for {
+		room := h.room(env.ClassCode, create)
+		if room == nil {
+			return
+		}
+		select {
+		case room.remoteIn <- env:
+			return
+		case <-room.done:
+		}
+	}
+}
+
+// Runs on the room loop.
+func (r *Room) publishStudentJoined(client *models.Client) {
+	r.hub.publish(&backplane.Envelope{
+		Kind:      backplane.KindStudentJoined,
+		ClassCode: r.code,
+		ClientID:  client.GetClientID(),
+		Email:     client.Email,
+	})
+}
+
+// Runs on the room loop.
+func (r *Room) publishStaffCount() {
+	r.hub.publish(&backplane.Envelope{
+		Kind:      backplane.KindStaffCount,
+		ClassCode: r.code,
+		Count:     len(r.staff()),
+	})
+}
+
+// handleRemote applies an envelope from another instance
+func (r *Room) handleRemote(env *backplane.Envelope) {
+	// Relays and commands only read membership, like handleBroadcast
+	switch env.Kind {
+	case backplane.KindRelay:
+		r.deliverLocal(env.Target, env.Payload)
+		return
+	case backplane.KindStream:
+		r.deliverStream(env.Payload)
+		return
+	case backplane.KindCommand:
+		r.deliverRemoteCommand(env)
+		return
+	case backplane.KindCommandReply:
+		r.handleRemoteCommandReply(env)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch env.Kind {
+	case backplane.KindStudentJoined:
+		// announce() repeats every student on each sync request and redial,
+		// so staff only hear about IDs they don't already know
+		known, ok := r.remote[env.ClientID]
+		r.remote[env.ClientID] = &remoteStudent{origin: env.Origin, email: env.Email}
+		if (ok && known.origin == env.Origin) || r.hasLocalStudent(env.ClientID) {
+			return
+		}
+		r.sendToStaff(models.Envelope{
+			Type: "student_connected",
+			Data: models.StudentConnected{ClientID: env.ClientID, Email: env.Email},
+		})
+
+	case backplane.KindStudentLeft:
+		if rs, ok := r.remote[env.ClientID]; ok && rs.origin == env.Origin {
+			delete(r.remote, env.ClientID)
+			if !r.hasLocalStudent(env.ClientID) {
+				r.notifyStudentDisconnected(env.ClientID)
+			}
+		}
+
+	case backplane.KindStaffCount:
+		if env.Count > 0 {
+			r.remoteStaff[env.Origin] = env.Count
+		} else {
+			delete(r.remoteStaff, env.Origin)
+		}
+
+	case backplane.KindSyncRequest:
+		r.announce()
+
+	case backplane.KindKick:
+		r.kickLocal(env.ClientID, string(env.Payload))
+
+	case backplane.KindPeerDown:
+		r.forgetInstance(env.Origin)
+	}
+}
+
+// announce re-publishes local students and the staff count so a peer can
+// rebuild its view of the class.
+func (r *Room) announce() {
+	for _, s := range r.students {
+		r.publishStudentJoined(s)
+	}
+	for _, d := range r.detached {
+		r.publishStudentJoined(d.client)
+	}
+	if len(r.staff()) > 0 {
+		r.publishStaffCount()
+	}
+}
+
+// forgetInstance drops everything learned from an instance whose link was lost.
+func (r *Room) forgetInstance(origin string) {
+	delete(r.remoteStaff, origin)
+	for id, rs := range r.remote {
+		if rs.origin != origin {
+			continue
+		}
+		delete(r.remote, id)
+		if !r.hasLocalStudent(id) {
+			r.notifyStudentDisconnected(id)
+		}
+	}
+	r.hub.logger.Warn(fmt.Sprintf("Backplane instance %s gone, forgot its students in %s", origin, r.code))
+}
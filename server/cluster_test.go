@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+	"testing"
+)
+
+// Peers re-announce their students on every sync request and redial; staff
+// should only see a student_connected for the ones that are new
+func TestRemoteJoinNotifiesOnce(t *testing.T) {
+	h := benchHub()
+	defer shutdown(t, h)
+	teacher := benchClient("teacher", "t1", "C1", false)
+	h.Register(teacher)
+	expect(t, teacher, "teacher_registered")
+	local := benchClient("student", "s1", "C1", false)
+	h.Register(local)
+	expect(t, teacher, "student_connected")
+
+	joined := func(origin, id string) {
+		h.dispatchRemote(&backplane.Envelope{
+			Kind:      backplane.KindStudentJoined,
+			ClassCode: "C1",
+			Origin:    origin,
+			ClientID:  id,
+		})
+	}
+	// The next student_connected the teacher gets
+	next := func() string {
+		var sc models.StudentConnected
+		json.Unmarshal(expect(t, teacher, "student_connected").Data, &sc)
+		return sc.ClientID
+	}
+
+	cases := []struct {
+		name, origin, id string
+		notify           bool
+	}{
+		{"new remote student", "A", "r1", true},
+		{"announced again", "A", "r1", false},
+		{"moved to another instance", "B", "r1", true},
+		{"announced again after moving", "B", "r1", false},
+		{"also connected here", "A", "s1", false},
+	}
+	for i, c := range cases {
+		joined(c.origin, c.id)
+		// A fresh ID after each case shows whether anything came before it
+		marker := fmt.Sprintf("marker%d", i)
+		joined("A", marker)
+		want := marker
+		if c.notify {
+			want = c.id
+		}
+		if got := next(); got != want {
+			t.Errorf("%s: student_connected for %s, want %s", c.name, got, want)
+		}
+		if c.notify {
+			next()
+		}
+	}
+
+	room := h.room("C1", false)
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if rs := room.remote["r1"]; rs == nil || rs.origin != "B" {
+		t.Errorf("r1's entry %+v, want it refreshed to origin B", rs)
+	}
+}
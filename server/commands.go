@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/audit"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+	"saber-websocket/policy"
+	"time"
+)
+
+// Command states reported to dashboards in command_status
+const (
+	CommandDelivered    = "delivered"    // Queued on the student's connection
+	CommandAcknowledged = "acknowledged" // Student sent command_ack
+	CommandCompleted    = "completed"    // Student sent command_result
+	CommandFailed       = "failed"       // Not deliverable, or the student reported an error
+	CommandTimedOut     = "timed_out"    // Student never acknowledged
+)
+
+// Command is a teacher_command on its way to a student, or a
+// teacher_broadcast on its way to the whole class
+type Command struct {
+	Issuer    *models.Client
+	Target    string // Student clientId; unused for broadcasts
+	Broadcast bool
+	Name      string
+	Data      interface{}
+	RequestID string // Optional dashboard correlation ID, echoed in command_status
+}
+
+// CommandReply is a state change for a command, raised by the student
+// (command_ack / command_result) or by the instance that delivered it
+type CommandReply struct {
+	CommandID string      `json:"commandId"`
+	ClientID  string      `json:"clientId"` // Student the command was for
+	State     string      `json:"state"`
+	Reason    string      `json:"reason,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Acks      bool        `json:"acks,omitempty"` // Delivered to a student that will ack
+
+	remote bool // Arrived over the backplane
+}
+
+// pendingCommand is a command the issuer's room is still waiting on
+type pendingCommand struct {
+	id        string
+	requestID string
+	name      string
+	target    string
+	issuer    *models.Client
+	state     string
+	timer     *time.Timer
+}
+
+// AttachCommandPolicy sets the policy teacher commands are checked against.
+// Call it before Run.
+func (h *Hub) AttachCommandPolicy(p *policy.Policy) {
+	h.policy = p
+}
+
+// CommandPolicy returns the attached policy; nil allows every command
+func (h *Hub) CommandPolicy() *policy.Policy {
+	return h.policy
+}
+
+// SendCommand hands a command to the issuer's class loop, which assigns its
+// commandId and tracks it until the student answers or it times out.
+func (h *Hub) SendCommand(cmd *Command) {
+	if room := h.room(cmd.Issuer.ClassCode, false); room != nil {
+		select {
+		case room.commands <- cmd:
+		case <-room.done:
+		}
+	}
+}
+
+// CommandReply passes a student's command_ack/command_result to its class loop
+func (h *Hub) CommandReply(student *models.Client, reply *CommandReply) {
+	if room := h.room(student.ClassCode, false); room != nil {
+		select {
+		case room.commandReplies <- reply:
+		case <-room.done:
+		}
+	}
+}
+
+// handleCommand delivers a command to a local student, or forwards it to the
+// instance the student is on. Runs on the room loop.
+func (r *Room) handleCommand(cmd *Command) {
+	if cmd.Broadcast {
+		r.broadcastCommand(cmd)
+		return
+	}
+	pc := &pendingCommand{
+		id:        newToken()[:16],
+		requestID: cmd.RequestID,
+		name:      cmd.Name,
+		target:    cmd.Target,
+		issuer:    cmd.Issuer,
+	}
+	msg, err := json.Marshal(models.StudentCommand{
+		Command:   cmd.Name,
+		Data:      cmd.Data,
+		CommandID: pc.id,
+	})
+	if err != nil {
+		return
+	}
+	r.auditCommand(audit.EventCommand, pc, "", cmd.Data)
+
+	if student, ok := r.students[cmd.Target]; ok {
+		if !student.TrySendControl(msg) {
+			r.hub.logger.Warn("Command dropped, student buffer full")
+			r.commandStatus(pc, CommandFailed, "Student is not keeping up", nil)
+			return
+		}
+		r.commandStatus(pc, CommandDelivered, "", nil)
+		// Extensions without acks never answer, so delivered is final
+		if student.HasCapability(models.CapAcks) {
+			r.trackCommand(pc)
+		} else {
+			r.auditCommand(audit.EventCommandResult, pc, CommandDelivered, nil)
+		}
+		return
+	}
+
+	if _, parked := r.detached[cmd.Target]; parked {
+		r.commandStatus(pc, CommandFailed, "Student is reconnecting", nil)
+		return
+	}
+
+	// Student lives on another instance; it reports delivery back
+	if _, ok := r.remote[cmd.Target]; ok {
+		r.hub.publish(&backplane.Envelope{
+			Kind:      backplane.KindCommand,
+			ClassCode: r.code,
+			ClientID:  cmd.Target,
+			CommandID: pc.id,
+			Payload:   msg,
+		})
+		r.trackCommand(pc)
+		return
+	}
+
+	r.commandStatus(pc, CommandFailed, "Student not found", nil)
+}
+
+// trackCommand waits for the next reply, up to CommandTimeout
+func (r *Room) trackCommand(pc *pendingCommand) {
+	r.pending[pc.id] = pc
+	id := pc.id
+	pc.timer = time.AfterFunc(r.hub.config.CommandTimeout, func() {
+		select {
+		case r.commandExpire <- id:
+		case <-r.done:
+		}
+	})
+}
+
+// broadcastCommand delivers a command to every student of the class, here and
+// on other instances. Broadcasts carry no commandId, so extensions don't ack
+// them and nothing is tracked. Runs on the room loop.
+func (r *Room) broadcastCommand(cmd *Command) {
+	msg, err := json.Marshal(models.StudentCommand{Command: cmd.Name, Data: cmd.Data})
+	if err != nil {
+		return
+	}
+	delivered := 0
+	for _, student := range r.students {
+		if student.TrySendControl(msg) {
+			delivered++
+		}
+	}
+	if r.hasRemoteAudience(models.TargetStudents) {
+		r.hub.publish(&backplane.Envelope{
+			Kind:      backplane.KindRelay,
+			ClassCode: r.code,
+			Target:    models.TargetStudents,
+			Payload:   msg,
+		})
+	}
+	r.auditBroadcast(cmd, fmt.Sprintf("%d of %d local students, %d remote", delivered, len(r.students), len(r.remote)))
+}
+
+func (r *Room) untrackCommand(pc *pendingCommand) {
+	pc.timer.Stop()
+	delete(r.pending, pc.id)
+}
+
+// handleCommandReply advances a tracked command. Replies for commands issued
+// on another instance are forwarded there. Runs on the room loop.
+func (r *Room) handleCommandReply(reply *CommandReply) {
+	pc, ok := r.pending[reply.CommandID]
+	if !ok {
+		if !reply.remote && r.hasRemoteAudience(models.TargetStaff) {
+			r.publishCommandReply(reply)
+		}
+		return
+	}
+	// Only the student the command was sent to may answer it
+	if pc.target != reply.ClientID {
+		return
+	}
+
+	switch reply.State {
+	case CommandDelivered:
+		r.commandStatus(pc, CommandDelivered, "", nil)
+		if !reply.Acks {
+			r.untrackCommand(pc)
+			r.auditCommand(audit.EventCommandResult, pc, CommandDelivered, nil)
+		}
+	case CommandAcknowledged:
+		// Keep listening for a result for another window
+		r.commandStatus(pc, CommandAcknowledged, "", nil)
+		pc.timer.Reset(r.hub.config.CommandTimeout)
+	case CommandCompleted, CommandFailed:
+		r.commandStatus(pc, reply.State, reply.Reason, reply.Result)
+		r.untrackCommand(pc)
+	}
+}
+
+// handleCommandTimeout gives up on a command. A command that was already
+// acknowledged just stops waiting for its (optional) result.
+func (r *Room) handleCommandTimeout(id string) {
+	pc, ok := r.pending[id]
+	if !ok {
+		return
+	}
+	delete(r.pending, id)
+	if pc.state != CommandAcknowledged {
+		r.commandStatus(pc, CommandTimedOut, "Student did not acknowledge", nil)
+	} else {
+		r.auditCommand(audit.EventCommandResult, pc, CommandAcknowledged, nil)
+	}
+}
+
+// commandStatus reports a state change to the issuing dashboard. Dashboards
+// that didn't negotiate acks only hear about failures, as command_failed.
+func (r *Room) commandStatus(pc *pendingCommand, state, reason string, result interface{}) {
+	pc.state = state
+	switch state {
+	case CommandCompleted, CommandFailed, CommandTimedOut:
+		detail := state
+		if reason != "" {
+			detail += ": " + reason
+		}
+		r.auditCommand(audit.EventCommandResult, pc, detail, result)
+	}
+
+	if !pc.issuer.HasCapability(models.CapAcks) {
+		if state != CommandFailed && state != CommandTimedOut {
+			return
+		}
+		failMsg, _ := json.Marshal(models.Envelope{
+			Type: "command_failed",
+			Data: models.CommandFailed{TargetClientID: pc.target, Reason: reason},
+		})
+		trySend(pc.issuer, failMsg)
+		return
+	}
+
+	msg, _ := json.Marshal(models.Envelope{
+		Type: "command_status",
+		Data: models.CommandStatus{
+			CommandID:      pc.id,
+			TargetClientID: pc.target,
+			Command:        pc.name,
+			State:          state,
+			RequestID:      pc.requestID,
+			Reason:         reason,
+			Result:         result,
+		},
+	})
+	trySend(pc.issuer, msg)
+}
+
+// deliverRemoteCommand hands a command forwarded by another instance to a
+// local student and reports the outcome back. Runs on the room loop.
+func (r *Room) deliverRemoteCommand(env *backplane.Envelope) {
+	reply := &CommandReply{CommandID: env.CommandID, ClientID: env.ClientID, State: CommandDelivered}
+	if student, ok := r.students[env.ClientID]; !ok {
+		reply.State, reply.Reason = CommandFailed, "Student not found"
+	} else if !student.TrySendControl(env.Payload) {
+		r.hub.logger.Warn("Command dropped, student buffer full")
+		reply.State, reply.Reason = CommandFailed, "Student is not keeping up"
+	} else {
+		reply.Acks = student.HasCapability(models.CapAcks)
+	}
+	r.publishCommandReply(reply)
+}
+
+func (r *Room) publishCommandReply(reply *CommandReply) {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	r.hub.publish(&backplane.Envelope{
+		Kind:      backplane.KindCommandReply,
+		ClassCode: r.code,
+		ClientID:  reply.ClientID,
+		CommandID: reply.CommandID,
+		Payload:   payload,
+	})
+}
+
+// handleRemoteCommandReply applies a reply published by another instance
+func (r *Room) handleRemoteCommandReply(env *backplane.Envelope) {
+	reply := &CommandReply{}
+	if err := json.Unmarshal(env.Payload, reply); err != nil {
+		r.hub.logger.Warn(fmt.Sprintf("Bad command reply from %s: %v", env.Origin, err))
+		return
+	}
+	reply.remote = true
+	r.handleCommandReply(reply)
+}
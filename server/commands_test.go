@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+	"testing"
+	"time"
+)
+
+// commandHub is a hub whose commands time out after timeout
+func commandHub(timeout time.Duration) *Hub {
+	h := studentHub("replace")
+	h.config.CommandTimeout = timeout
+	return h
+}
+
+// withAcks negotiates command acks for c, as hello would
+func withAcks(c *models.Client) *models.Client {
+	c.SetProtocol(models.ProtocolV2, []string{models.CapAcks})
+	return c
+}
+
+// classroom registers an owner and one student and waits until the owner
+// has seen the student join
+func classroom(t *testing.T, h *Hub, teacher, student *models.Client) {
+	t.Helper()
+	h.Register(teacher)
+	expect(t, teacher, "teacher_registered")
+	h.Register(student)
+	expect(t, student, "student_registered")
+	expect(t, teacher, "student_connected")
+}
+
+// status reads the issuer's next command_status
+func status(t *testing.T, c *models.Client) models.CommandStatus {
+	t.Helper()
+	var s models.CommandStatus
+	if err := json.Unmarshal(expect(t, c, "command_status").Data, &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// forgotten checks that the issuer's room no longer tracks command id: a
+// late reply for it is ignored. Replies are handled in order, so a second
+// command's result shows whether the late one did anything.
+// The student may be connected to another hub than the issuer.
+func forgotten(t *testing.T, issuerHub, studentHub *Hub, issuer, student *models.Client, id string) {
+	t.Helper()
+	issuerHub.SendCommand(&Command{Issuer: issuer, Target: student.GetClientID(), Name: "ping_student"})
+	next := expect(t, student, "ping_student")
+	status(t, issuer) // delivered
+	studentHub.CommandReply(student, &CommandReply{CommandID: id, ClientID: student.GetClientID(), State: CommandAcknowledged})
+	studentHub.CommandReply(student, &CommandReply{CommandID: next.CommandID, ClientID: student.GetClientID(), State: CommandCompleted})
+	if s := status(t, issuer); s.CommandID != next.CommandID || s.State != CommandCompleted {
+		t.Errorf("status %+v after a late reply for %s, want %s completed", s, id, next.CommandID)
+	}
+}
+
+// quiet fails if c has a command_status or command_failed queued
+func quiet(t *testing.T, c *models.Client) {
+	t.Helper()
+	for {
+		select {
+		case raw := <-c.Send:
+			var m message
+			json.Unmarshal(raw, &m)
+			if m.Type == "command_status" || m.Type == "command_failed" {
+				t.Errorf("%s: unexpected %s", c.GetClientID(), raw)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestCommandLifecycle(t *testing.T) {
+	cases := []struct {
+		name    string
+		replies []CommandReply // ClientID defaults to the target
+		states  []string       // command_status states after delivered
+		reason  string         // On the last status
+	}{
+		{
+			"acknowledged then completed",
+			[]CommandReply{{State: CommandAcknowledged}, {State: CommandCompleted, Result: "ok"}},
+			[]string{CommandAcknowledged, CommandCompleted}, "",
+		},
+		{
+			"acknowledged then failed",
+			[]CommandReply{{State: CommandAcknowledged}, {State: CommandFailed, Reason: "tab blocked"}},
+			[]string{CommandAcknowledged, CommandFailed}, "tab blocked",
+		},
+		{
+			"result without an ack",
+			[]CommandReply{{State: CommandCompleted}},
+			[]string{CommandCompleted}, "",
+		},
+		{
+			"only the target may answer",
+			[]CommandReply{{ClientID: "s2", State: CommandFailed, Reason: "not mine"}, {State: CommandCompleted}},
+			[]string{CommandCompleted}, "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := commandHub(time.Minute)
+			defer shutdown(t, h)
+			teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+			student := withAcks(benchClient("student", "s1", "C1", false))
+			classroom(t, h, teacher, student)
+
+			h.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "open_tab", Data: map[string]string{"url": "https://example.com"}, RequestID: "r1"})
+			cmd := expect(t, student, "open_tab")
+			if cmd.CommandID == "" {
+				t.Fatal("command delivered without a commandId")
+			}
+			s := status(t, teacher)
+			if s.State != CommandDelivered || s.CommandID != cmd.CommandID || s.TargetClientID != "s1" || s.Command != "open_tab" || s.RequestID != "r1" {
+				t.Fatalf("first status %+v, want delivered for %s", s, cmd.CommandID)
+			}
+
+			for _, reply := range c.replies {
+				reply := reply
+				reply.CommandID = cmd.CommandID
+				if reply.ClientID == "" {
+					reply.ClientID = "s1"
+				}
+				h.CommandReply(student, &reply)
+			}
+			for i, want := range c.states {
+				s := status(t, teacher)
+				if s.State != want || s.CommandID != cmd.CommandID || s.RequestID != "r1" {
+					t.Errorf("status %d: %+v, want %s", i+1, s, want)
+				}
+				if i == len(c.states)-1 && s.Reason != c.reason {
+					t.Errorf("final reason %q, want %q", s.Reason, c.reason)
+				}
+			}
+			forgotten(t, h, h, teacher, student, cmd.CommandID)
+			quiet(t, teacher)
+		})
+	}
+}
+
+// A student that never negotiated acks won't answer, so delivered is final
+func TestCommandToStudentWithoutAcks(t *testing.T) {
+	h := commandHub(20 * time.Millisecond)
+	defer shutdown(t, h)
+	teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+	student := benchClient("student", "s1", "C1", false)
+	classroom(t, h, teacher, student)
+
+	h.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen"})
+	expect(t, student, "lock_screen")
+	if s := status(t, teacher); s.State != CommandDelivered {
+		t.Errorf("status %+v, want delivered", s)
+	}
+	time.Sleep(50 * time.Millisecond) // Well past CommandTimeout
+	quiet(t, teacher)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	t.Run("never acknowledged", func(t *testing.T) {
+		h := commandHub(timeout)
+		defer shutdown(t, h)
+		teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+		student := withAcks(benchClient("student", "s1", "C1", false))
+		classroom(t, h, teacher, student)
+
+		h.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen"})
+		cmd := expect(t, student, "lock_screen")
+		status(t, teacher) // delivered
+		s := status(t, teacher)
+		if s.State != CommandTimedOut || s.Reason != "Student did not acknowledge" {
+			t.Errorf("status %+v, want timed_out", s)
+		}
+		forgotten(t, h, h, teacher, student, cmd.CommandID)
+	})
+
+	t.Run("acknowledged", func(t *testing.T) {
+		h := commandHub(timeout)
+		defer shutdown(t, h)
+		teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+		student := withAcks(benchClient("student", "s1", "C1", false))
+		classroom(t, h, teacher, student)
+
+		h.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen"})
+		cmd := expect(t, student, "lock_screen")
+		status(t, teacher) // delivered
+		h.CommandReply(student, &CommandReply{CommandID: cmd.CommandID, ClientID: "s1", State: CommandAcknowledged})
+		if s := status(t, teacher); s.State != CommandAcknowledged {
+			t.Fatalf("status %+v, want acknowledged", s)
+		}
+		// The result is optional once acknowledged; the wait just ends
+		time.Sleep(2 * timeout)
+		quiet(t, teacher)
+		forgotten(t, h, h, teacher, student, cmd.CommandID)
+	})
+
+	t.Run("issuer without acks", func(t *testing.T) {
+		h := commandHub(timeout)
+		defer shutdown(t, h)
+		teacher := benchClient("teacher", "t1", "C1", false)
+		student := withAcks(benchClient("student", "s1", "C1", false))
+		classroom(t, h, teacher, student)
+
+		h.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen"})
+		expect(t, student, "lock_screen")
+		var f models.CommandFailed
+		json.Unmarshal(expect(t, teacher, "command_failed").Data, &f)
+		if f.TargetClientID != "s1" || f.Reason != "Student did not acknowledge" {
+			t.Errorf("command_failed %+v, want s1 timed out", f)
+		}
+		quiet(t, teacher)
+	})
+}
+
+// Commands that can't be delivered fail straight away; dashboards without
+// acks hear about it as command_failed
+func TestCommandUndeliverable(t *testing.T) {
+	cases := []struct {
+		name   string
+		acks   bool
+		target string
+		reason string
+	}{
+		{"unknown student", true, "nobody", "Student not found"},
+		{"unknown student, no acks", false, "nobody", "Student not found"},
+		{"reconnecting student", true, "s1", "Student is reconnecting"},
+		{"reconnecting student, no acks", false, "s1", "Student is reconnecting"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := commandHub(time.Minute)
+			defer shutdown(t, h)
+			teacher := benchClient("teacher", "t1", "C1", false)
+			if c.acks {
+				withAcks(teacher)
+			}
+			student := withAcks(benchClient("student", "s1", "C1", false))
+			classroom(t, h, teacher, student)
+			drop(t, h, student)
+
+			h.SendCommand(&Command{Issuer: teacher, Target: c.target, Name: "lock_screen"})
+			if c.acks {
+				s := status(t, teacher)
+				if s.State != CommandFailed || s.TargetClientID != c.target || s.Reason != c.reason {
+					t.Errorf("status %+v, want failed: %s", s, c.reason)
+				}
+			} else {
+				var f models.CommandFailed
+				json.Unmarshal(expect(t, teacher, "command_failed").Data, &f)
+				if f.TargetClientID != c.target || f.Reason != c.reason {
+					t.Errorf("command_failed %+v, want %s: %s", f, c.target, c.reason)
+				}
+			}
+			quiet(t, teacher)
+		})
+	}
+}
+
+// cluster starts n hubs sharing an in-memory backplane
+func cluster(t *testing.T, n int, timeout time.Duration) []*Hub {
+	t.Helper()
+	bus := backplane.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	hubs := make([]*Hub, n)
+	for i := range hubs {
+		h := commandHub(timeout)
+		h.config.InstanceID = string(rune('A' + i))
+		h.AttachBackplane(bus.Join(h.config.InstanceID))
+		go h.Run(ctx)
+		hubs[i] = h
+	}
+	t.Cleanup(func() {
+		for _, h := range hubs {
+			shutdown(t, h)
+		}
+		cancel()
+	})
+	return hubs
+}
+
+// A command for a student on another instance goes over the backplane, and
+// the student's replies come back the same way
+func TestRemoteCommand(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	cases := []struct {
+		name       string
+		studentAck bool
+		replies    []CommandReply
+		states     []string // After delivered
+	}{
+		{
+			"acknowledged then completed", true,
+			[]CommandReply{{State: CommandAcknowledged}, {State: CommandCompleted, Result: "ok"}},
+			[]string{CommandAcknowledged, CommandCompleted},
+		},
+		{
+			"failed", true,
+			[]CommandReply{{State: CommandFailed, Reason: "tab blocked"}},
+			[]string{CommandFailed},
+		},
+		{"student without acks", false, nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hubs := cluster(t, 2, timeout)
+			a, b := hubs[0], hubs[1]
+			teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+			a.Register(teacher)
+			expect(t, teacher, "teacher_registered")
+			// b has to know there are staff on a before it forwards replies
+			waitFor(t, "staff count on b", func() bool {
+				room := b.room("C1", false)
+				if room == nil {
+					return false
+				}
+				room.mu.RLock()
+				defer room.mu.RUnlock()
+				return room.remoteStaff["A"] > 0
+			})
+			student := benchClient("student", "s1", "C1", false)
+			if c.studentAck {
+				withAcks(student)
+			}
+			b.Register(student)
+			expect(t, student, "student_registered")
+			expect(t, teacher, "student_connected")
+
+			a.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen", RequestID: "r1"})
+			cmd := expect(t, student, "lock_screen")
+			if s := status(t, teacher); s.State != CommandDelivered || s.CommandID != cmd.CommandID || s.RequestID != "r1" {
+				t.Fatalf("first status %+v, want delivered for %s", s, cmd.CommandID)
+			}
+
+			for _, reply := range c.replies {
+				reply := reply
+				reply.CommandID, reply.ClientID = cmd.CommandID, "s1"
+				b.CommandReply(student, &reply)
+			}
+			for i, want := range c.states {
+				if s := status(t, teacher); s.State != want || s.CommandID != cmd.CommandID {
+					t.Errorf("status %d: %+v, want %s", i+1, s, want)
+				}
+			}
+			if c.studentAck {
+				forgotten(t, a, b, teacher, student, cmd.CommandID)
+			} else {
+				// Nothing left to wait for, so nothing times out
+				time.Sleep(2 * timeout)
+			}
+			quiet(t, teacher)
+		})
+	}
+}
+
+// The instance that holds the student reports a failed delivery back
+func TestRemoteCommandStudentGone(t *testing.T) {
+	hubs := cluster(t, 2, time.Minute)
+	a, b := hubs[0], hubs[1]
+	teacher := withAcks(benchClient("teacher", "t1", "C1", false))
+	a.Register(teacher)
+	expect(t, teacher, "teacher_registered")
+
+	// a believes s1 is on b, but b has never seen it
+	a.dispatchRemote(&backplane.Envelope{Kind: backplane.KindStudentJoined, ClassCode: "C1", Origin: "B", ClientID: "s1"})
+	expect(t, teacher, "student_connected")
+	waitFor(t, "class on b", func() bool { return b.room("C1", false) != nil })
+
+	a.SendCommand(&Command{Issuer: teacher, Target: "s1", Name: "lock_screen"})
+	if s := status(t, teacher); s.State != CommandFailed || s.Reason != "Student not found" {
+		t.Errorf("status %+v, want failed: Student not found", s)
+	}
+}
@@ -1,199 +1,210 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"saber-websocket/audit"
+	"saber-websocket/backplane"
 	"saber-websocket/config"
 	"saber-websocket/models"
+	"saber-websocket/policy"
 	"saber-websocket/utils"
 	"sync"
 )
 
+// Hub routes clients to their class. Each class is a Room with its own event
+// loop and lock, so classes never wait on each other; the hub itself only
+// guards the class directory.
 type Hub struct {
-	students   map[string]*models.Client
-	teacher    *models.Client
-	register   chan *models.Client
-	unregister chan *models.Client
-	broadcast  chan *models.BroadcastMessage
-	config     *config.Config
-	logger     *utils.Logger
-	mu         sync.RWMutex
+	rooms     map[string]*Room
+	remote    chan *backplane.Envelope
+	backplane backplane.Backplane // nil when running as a single instance
+	policy    *policy.Policy      // nil relays any command
+	audit     *audit.Log          // nil records nothing
+	config    *config.Config
+	logger    *utils.Logger
+	closing   bool         // Set by Shutdown; refuses new rooms
+	mu        sync.RWMutex // Guards rooms and closing
 }
 
 func NewHub(cfg *config.Config, logger *utils.Logger) *Hub {
 	return &Hub{
-		students:   make(map[string]*models.Client),
-		teacher:    nil,
-		register:   make(chan *models.Client),
-		unregister: make(chan *models.Client),
-		broadcast:  make(chan *models.BroadcastMessage, 256), // Larger buffer for control messages
-		config:     cfg,
-		logger:     logger,
+		rooms:  make(map[string]*Room),
+		remote: make(chan *backplane.Envelope, 1024),
+		config: cfg,
+		logger: logger,
 	}
 }
 
-func (h *Hub) Run() {
+// Run dispatches backplane traffic to the class loops until ctx is done.
+// Local traffic goes straight to the rooms through Register, Unregister and
+// Broadcast. Once ctx is done Run closes every class (as Shutdown does, but
+// without waiting for sockets to flush) and returns after the room loops
+// have exited. Call Shutdown first to give clients a graceful drain.
+func (h *Hub) Run(ctx context.Context) {
 	for {
 		select {
-		case client := <-h.register:
-			h.handleRegister(client)
-
-		case client := <-h.unregister:
-			h.handleUnregister(client)
-
-		case message := <-h.broadcast:
-			h.handleBroadcast(message)
+		case env := <-h.remote:
+			h.dispatchRemote(env)
+		case <-ctx.Done():
+			h.closeRooms(context.Background())
+			return
 		}
 	}
 }
 
-// GetTeacherSafe returns the teacher client pointer safely.
-// This allows handlers to bypass the main Hub loop for streaming.
-func (h *Hub) GetTeacherSafe() *models.Client {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.teacher
-}
-
-// GetStudentSafe returns a student client pointer safely.
-func (h *Hub) GetStudentSafe(clientID string) *models.Client {
+// room returns the room for a class code, optionally creating (and starting) it.
+func (h *Hub) room(classCode string, create bool) *Room {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.students[clientID]
-}
+	room, ok := h.rooms[classCode]
+	h.mu.RUnlock()
+	if ok || !create {
+		return room
+	}
 
-func (h *Hub) handleRegister(client *models.Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-
-	if client.ClientType == "teacher" {
-		if h.teacher != nil {
-			h.logger.Warn("New teacher connecting, closing old session")
-			close(h.teacher.Send)
-		}
-		h.teacher = client
-		h.logger.Info("Teacher connected")
-		
-		// Push initial state immediately
-		go h.sendInitialStudentList(client)
-
-	} else if client.ClientType == "student" {
-		if len(h.students) >= h.config.MaxStudents {
-			h.sendError(client, "Class is full")
-			close(client.Send)
-			return
-		}
-
-		h.students[client.ClientID] = client
-		h.logger.Info(fmt.Sprintf("Student + : %s (%s)", client.Email, client.ClientID))
-
-		// Notify Teacher (Control Message)
-		if h.teacher != nil {
-			h.sendToTeacherInternal(map[string]interface{}{
-				"type": "student_connected",
-				"data": map[string]interface{}{
-					"clientId": client.ClientID,
-					"email":    client.Email,
-				},
-			})
-		}
+	if h.closing {
+		return nil
 	}
+	if room, ok = h.rooms[classCode]; !ok {
+		room = newRoom(classCode, h)
+		h.rooms[classCode] = room
+		go room.run()
+		h.logger.Info(fmt.Sprintf("Class opened: %s (%d active)", classCode, len(h.rooms)))
+	}
+	return room
 }
 
-func (h *Hub) handleUnregister(client *models.Client) {
+// retireRoom removes an empty room from the directory. Senders still holding
+// the room see its done channel close and retry against a fresh room.
+func (h *Hub) retireRoom(room *Room) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if client.ClientType == "teacher" {
-		if h.teacher == client {
-			h.teacher = nil
-			close(client.Send)
-			h.logger.Info("Teacher disconnected")
-		}
-	} else if client.ClientType == "student" {
-		if _, ok := h.students[client.ClientID]; ok {
-			delete(h.students, client.ClientID)
-			close(client.Send)
-			h.logger.Info(fmt.Sprintf("Student - : %s", client.ClientID))
-
-			if h.teacher != nil {
-				h.sendToTeacherInternal(map[string]interface{}{
-					"type": "student_disconnected",
-					"data": map[string]interface{}{
-						"clientId": client.ClientID,
-					},
-				})
-			}
-		}
+	if h.rooms[room.code] == room {
+		delete(h.rooms, room.code)
 	}
+	active := len(h.rooms)
+	close(room.done)
+	h.mu.Unlock()
+	h.logger.Info(fmt.Sprintf("Class closed: %s (%d active)", room.code, active))
 }
 
-// handleBroadcast processes low-priority control messages (chat, commands)
-func (h *Hub) handleBroadcast(message *models.BroadcastMessage) {
+// allRooms snapshots the directory
+func (h *Hub) allRooms() []*Room {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
 
-	if message.Target == "teacher" && h.teacher != nil {
-		h.trySend(h.teacher, message.Message)
-	} else if message.Target == "student" {
-		for _, s := range h.students {
-			h.trySend(s, message.Message)
-		}
-	} else if client, ok := h.students[message.Target]; ok {
-		h.trySend(client, message.Message)
+// GetTeacherSafe returns the teacher client pointer for a class safely.
+// This allows handlers to bypass the room loop for streaming.
+func (h *Hub) GetTeacherSafe(classCode string) *models.Client {
+	if room := h.room(classCode, false); room != nil {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.teacher
 	}
+	return nil
 }
 
-// trySend attempts to send a message. If buffer is full, it drops it (Backpressure).
-func (h *Hub) trySend(client *models.Client, msg []byte) {
-	select {
-	case client.Send <- msg:
-	default:
-		// Buffer full - Drop message to prevent server blocking
-		// This is acceptable for real-time systems
+// GetStaffSafe returns every staff dashboard (all roles) in a class safely.
+// Used by the screenshot fast path to fan out without going through the room loop.
+func (h *Hub) GetStaffSafe(classCode string) []*models.Client {
+	if room := h.room(classCode, false); room != nil {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.staff()
+	}
+	return nil
+}
+
+// GetStudentSafe returns a student client pointer within a class safely.
+func (h *Hub) GetStudentSafe(classCode, clientID string) *models.Client {
+	if room := h.room(classCode, false); room != nil {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.students[clientID]
 	}
+	return nil
 }
 
-// Internal helper to send map as json
-func (h *Hub) sendToTeacherInternal(msg interface{}) {
+// trySend attempts to send a message. If buffer is full, it drops it (Backpressure).
+func trySend(client *models.Client, msg []byte) bool {
+	// Buffer full - Drop message to prevent server blocking
+	// This is acceptable for real-time systems; sequenced clients get a
+	// resync for whatever was dropped
+	return client.TrySendControl(msg)
+}
+
+func sendError(client *models.Client, errorMsg string) {
+	msg := models.ErrorReply{Type: "error", Message: errorMsg}
 	if data, err := json.Marshal(msg); err == nil {
-		if h.teacher != nil {
-			h.trySend(h.teacher, data)
-		}
+		client.TrySend(data)
 	}
 }
 
-func (h *Hub) sendError(client *models.Client, errorMsg string) {
-	msg := map[string]interface{}{"type": "error", "message": errorMsg}
+func sendErrorCode(client *models.Client, code, errorMsg string) {
+	msg := models.ErrorReply{Type: "error", Code: code, Message: errorMsg}
 	if data, err := json.Marshal(msg); err == nil {
-		client.Send <- data
+		client.TrySend(data)
 	}
 }
 
-func (h *Hub) sendInitialStudentList(teacher *models.Client) {
-	// Need lock to read map, but we're already inside a lock in handleRegister?
-	// No, this is called as a goroutine, so we need RLock
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-	list := make([]map[string]interface{}, 0, len(h.students))
-	for _, s := range h.students {
-		list = append(list, map[string]interface{}{
-			"clientId": s.ClientID,
-			"email":    s.Email,
-		})
-	}
+func tokensMatch(presented, issued string) bool {
+	return presented != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(issued)) == 1
+}
+
+// API Methods
 
-	msg := map[string]interface{}{
-		"type": "initial_student_list",
-		"data": list,
+// Register hands a client to its class loop, starting the class if needed
+func (h *Hub) Register(c *models.Client) {
+	for {
+		room := h.room(c.ClassCode, true)
+		if room == nil {
+			// Shutting down
+			c.CloseWith(models.CloseServerShutdown, "server_shutdown")
+			return
+		}
+		select {
+		case room.register <- c:
+			return
+		case <-room.done:
+			// Room retired while we were sending; retry on its successor
+		}
 	}
-	if data, err := json.Marshal(msg); err == nil {
-		h.trySend(teacher, data)
+}
+
+// Unregister releases a client. A retired room no longer holds it.
+func (h *Hub) Unregister(c *models.Client) {
+	if room := h.room(c.ClassCode, false); room != nil {
+		select {
+		case room.unregister <- c:
+		case <-room.done:
+		}
 	}
 }
 
-// API Methods
-func (h *Hub) Register(c *models.Client)   { h.register <- c }
-func (h *Hub) Unregister(c *models.Client) { h.unregister <- c }
-func (h *Hub) Broadcast(m *models.BroadcastMessage) { h.broadcast <- m }
\ No newline at end of file
+// Broadcast queues a control message for its class. Messages for a class
+// with nobody in it are dropped.
+func (h *Hub) Broadcast(m *models.BroadcastMessage) {
+	if room := h.room(m.ClassCode, false); room != nil {
+		select {
+		case room.broadcast <- m:
+		case <-room.done:
+		}
+	}
+}
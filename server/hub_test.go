@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"saber-websocket/models"
+	"testing"
+	"time"
+)
+
+// message is an outbound message as the tests look at it
+type message struct {
+	Type      string          `json:"type"`
+	Seq       uint64          `json:"seq"`
+	Code      string          `json:"code"`    // error
+	Command   string          `json:"command"` // Student commands have no type
+	CommandID string          `json:"commandId"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// expect reads c's messages until one of type typ arrives (for a student
+// command, one for command typ), skipping everything before it
+func expect(t *testing.T, c *models.Client, typ string) message {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case raw, ok := <-c.Send:
+			if !ok {
+				t.Fatalf("%s: closed while waiting for %s", c.GetClientID(), typ)
+			}
+			var m message
+			if err := json.Unmarshal(raw, &m); err != nil {
+				t.Fatalf("%s: %v in %s", c.GetClientID(), err, raw)
+			}
+			if m.Type == typ || (m.Type == "" && m.Command == typ) {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("%s: no %s", c.GetClientID(), typ)
+		}
+	}
+}
+
+// waitFor polls cond until it holds; room loops work asynchronously
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// closeCode waits for the room to close c and returns the close code; the
+// message explaining why is queued before the close
+func closeCode(t *testing.T, c *models.Client) int {
+	t.Helper()
+	waitFor(t, c.GetClientID()+" to close", func() bool {
+		code, _ := c.CloseInfo()
+		return code != 0
+	})
+	code, _ := c.CloseInfo()
+	return code
+}
+
+func shutdown(t *testing.T, h *Hub) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStopsRoomsOnCancel(t *testing.T) {
+	h := benchHub()
+	populate(h, 3)
+	rooms := h.allRooms()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	for _, room := range rooms {
+		select {
+		case <-room.done:
+		default:
+			t.Errorf("room %s still running after Run returned", room.code)
+		}
+	}
+	if n := len(h.allRooms()); n != 0 {
+		t.Errorf("%d rooms left in the directory", n)
+	}
+
+	// Closed for good: new clients are turned away
+	c := benchClient("student", "late", "C0", false)
+	h.Register(c)
+	if code, _ := c.CloseInfo(); code == 0 {
+		t.Error("registration accepted after Run returned")
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+	"time"
+)
+
+// Presence states pushed to staff as student_presence
+const (
+	PresenceActive       = "active"
+	PresenceIdle         = "idle"
+	PresenceUnresponsive = "unresponsive"
+)
+
+// presenceState is the last classification sent to staff for a student
+type presenceState struct {
+	state string
+	since time.Time
+}
+
+// classifyPresence derives a student's state from LastSeen, user activity and
+// the extension's idle hint.
+func classifyPresence(client *models.Client, now time.Time, idleAfter, unresponsiveAfter time.Duration) string {
+	lastSeen, lastActivity, hint := client.PresenceSnapshot()
+	if now.Sub(lastSeen) >= unresponsiveAfter {
+		return PresenceUnresponsive
+	}
+	if hint == "idle" || hint == "locked" {
+		return PresenceIdle
+	}
+	if now.Sub(lastActivity) >= idleAfter {
+		return PresenceIdle
+	}
+	return PresenceActive
+}
+
+// evaluatePresence reclassifies every live student and pushes transitions to
+// staff, including dashboards on other instances. Runs on the room loop.
+func (r *Room) evaluatePresence() {
+	now := time.Now()
+	cfg := r.hub.config
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, client := range r.students {
+		state := classifyPresence(client, now, cfg.IdleAfter, cfg.UnresponsiveAfter)
+		previous, known := r.presence[id]
+		if known && previous.state == state {
+			continue
+		}
+		r.presence[id] = presenceState{state: state, since: now}
+		// Everyone starts active; only announce a first state if it isn't
+		if !known && state == PresenceActive {
+			continue
+		}
+
+		lastSeen, lastActivity, _ := client.PresenceSnapshot()
+		prevState := PresenceActive
+		if known {
+			prevState = previous.state
+		}
+		r.relayToStaff(models.Envelope{
+			Type: "student_presence",
+			Data: models.StudentPresence{
+				ClientID:       id,
+				State:          state,
+				Previous:       prevState,
+				Since:          now.UnixMilli(),
+				LastSeen:       lastSeen.UnixMilli(),
+				LastActivityAt: lastActivity.UnixMilli(),
+			},
+		})
+	}
+}
+
+// presenceOf returns the last pushed state for a student (active if none yet)
+func (r *Room) presenceOf(clientID string) string {
+	if p, ok := r.presence[clientID]; ok {
+		return p.state
+	}
+	return PresenceActive
+}
+
+// relayToStaff sends a hub-generated event to local staff and to staff of
+// the class on other instances. Runs on the room loop.
+func (r *Room) relayToStaff(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	r.deliverLocal(models.TargetStaff, data)
+	if r.hasRemoteAudience(models.TargetStaff) {
+		r.hub.publish(&backplane.Envelope{
+			Kind:      backplane.KindRelay,
+			ClassCode: r.code,
+			Target:    models.TargetStaff,
+			Payload:   data,
+		})
+	}
+}
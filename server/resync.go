@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/models"
+	"sort"
+	"time"
+)
+
+// How often the room looks for dashboards that missed numbered messages
+const resyncInterval = time.Second
+
+// resyncStaff follows up dropped control messages with snapshots: the state
+// of each student a dropped message was about, or the whole roster when a
+// dropped message wasn't about one student. A snapshot that is dropped in
+// turn is retried on the next pass, covering its own number too. Runs on the room loop.
+func (r *Room) resyncStaff() {
+	for _, t := range r.staff() {
+		if !t.HasDropped() {
+			continue
+		}
+		dropped := t.TakeDropped()
+		if missed, ok := dropped[""]; ok {
+			if !r.sendInitialStudentList(t) {
+				t.RestoreDropped("", missed)
+			}
+			delete(dropped, "")
+		}
+
+		ids := make([]string, 0, len(dropped))
+		for id := range dropped {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if !r.sendStudentResync(t, id, dropped[id]) {
+				t.RestoreDropped(id, dropped[id])
+			}
+		}
+	}
+}
+
+// sendStudentResync sends a dashboard the current state of one student,
+// listing the sequence numbers it replaces as [from, to] ranges
+func (r *Room) sendStudentResync(t *models.Client, clientID string, missed []uint64) bool {
+	data := models.StudentResync{
+		ClientID: clientID,
+		Missed:   models.SeqRanges(missed),
+		State:    "disconnected",
+	}
+	if s, ok := r.students[clientID]; ok {
+		data.State = "connected"
+		data.Email = s.Email
+		data.Presence = r.presenceOf(clientID)
+		data.Tabs = s.GetCurrentTabs()
+	} else if d, ok := r.detached[clientID]; ok {
+		data.State = "reconnecting"
+		data.Email = d.client.Email
+		data.Tabs = d.client.GetCurrentTabs()
+	} else if rs, ok := r.remote[clientID]; ok {
+		// Tabs live on the other instance; its relays keep flowing
+		data.State = "connected"
+		data.Email = rs.email
+		data.Remote = true
+	}
+	msg := models.Envelope{
+		Type: "student_resync",
+		Data: data,
+	}
+	out, err := json.Marshal(msg)
+	return err == nil && trySend(t, out)
+}
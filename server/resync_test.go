@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/models"
+	"testing"
+	"time"
+)
+
+// A dashboard whose buffer fills up loses student_connected messages. Once it
+// drains, it gets a student_resync for each student it missed, and its seq
+// numbers account for every message: received, or listed as missed.
+func TestResyncAfterFullBuffer(t *testing.T) {
+	const buffer = 8
+	h := benchHub()
+	defer shutdown(t, h)
+
+	teacher := benchClient("teacher", "t1", "C1", false)
+	teacher.Send = make(chan []byte, buffer)
+	teacher.SetProtocol(models.ProtocolV2, []string{models.CapSeq})
+	h.Register(teacher)
+	// A second dashboard that keeps up, numbered on its own
+	other := dashboard("c1", models.RoleCoTeacher)
+	other.SetProtocol(models.ProtocolV2, []string{models.CapSeq})
+	h.Register(other)
+
+	var received []message
+	read := func(c *models.Client, typ string) message {
+		t.Helper()
+		m := expect(t, c, typ)
+		if c == teacher {
+			received = append(received, m)
+		}
+		return m
+	}
+	read(teacher, "teacher_registered")
+	read(teacher, "initial_student_list")
+	read(teacher, "staff_joined")
+
+	// Twice as many joins as the buffer holds; the rest are dropped
+	students := 2 * buffer
+	for i := 1; i <= students; i++ {
+		s := benchClient("student", fmt.Sprintf("s%02d", i), "C1", true)
+		h.Register(s)
+	}
+	waitFor(t, "students to join", func() bool {
+		room := h.room("C1", false)
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return len(room.students) == students
+	})
+
+	// Drain, reading until every student was either announced or resynced
+	seen := make(map[string]bool)
+	missed := make(map[uint64]bool)
+	resyncs := 0
+	deadline := time.After(3 * resyncInterval)
+	for len(seen) < students {
+		select {
+		case raw := <-teacher.Send:
+			var m message
+			if err := json.Unmarshal(raw, &m); err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, m)
+			switch m.Type {
+			case "student_connected":
+				var sc models.StudentConnected
+				json.Unmarshal(m.Data, &sc)
+				seen[sc.ClientID] = true
+			case "student_resync":
+				var rs models.StudentResync
+				json.Unmarshal(m.Data, &rs)
+				if rs.State != "connected" || len(rs.Missed) == 0 {
+					t.Errorf("resync %+v, want a connected student with missed ranges", rs)
+				}
+				seen[rs.ClientID] = true
+				resyncs++
+				for _, r := range rs.Missed {
+					for seq := r[0]; seq <= r[1]; seq++ {
+						missed[seq] = true
+					}
+				}
+			}
+		case <-deadline:
+			t.Fatalf("only %d of %d students announced or resynced", len(seen), students)
+		}
+	}
+	if resyncs == 0 {
+		t.Fatal("nothing was dropped; the buffer never filled")
+	}
+
+	// One more message after the resync carries on the numbering
+	last := received[len(received)-1].Seq
+	h.Register(benchClient("student", "late", "C1", true))
+	if m := read(teacher, "student_connected"); m.Seq != last+1 {
+		t.Errorf("seq after the resync %d, want %d", m.Seq, last+1)
+	}
+
+	// Each number was either received or listed as missed, never both
+	var next uint64 = 1
+	for _, m := range received {
+		for ; next < m.Seq; next++ {
+			if !missed[next] {
+				t.Errorf("seq %d neither received nor resynced", next)
+			}
+		}
+		if m.Seq != next {
+			t.Fatalf("seq %d (%s) after %d, want increasing numbers", m.Seq, m.Type, next-1)
+		}
+		if missed[m.Seq] {
+			t.Errorf("seq %d received and also listed as missed", m.Seq)
+		}
+		next++
+	}
+
+	// The dashboard that kept up has its own gap-free numbering
+	for i := uint64(1); ; i++ {
+		var m message
+		select {
+		case raw := <-other.Send:
+			json.Unmarshal(raw, &m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("other dashboard: no message %d", i)
+		}
+		if m.Seq != i {
+			t.Fatalf("other dashboard: seq %d (%s), want %d", m.Seq, m.Type, i)
+		}
+		if m.Type == "student_resync" {
+			t.Errorf("other dashboard resynced, but it dropped nothing")
+		}
+		var sc models.StudentConnected
+		if m.Type == "student_connected" && json.Unmarshal(m.Data, &sc) == nil && sc.ClientID == "late" {
+			return
+		}
+	}
+}
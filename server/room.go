@@ -0,0 +1,324 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/backplane"
+	"saber-websocket/models"
+	"sync"
+	"time"
+)
+
+// Room holds the isolated state for a single class and runs its own event
+// loop. Only the loop mutates the member maps, and it holds mu while doing
+// so; the fast-path readers outside the loop (screenshots, command lookup)
+// take mu for reading.
+type Room struct {
+	code string
+	hub  *Hub
+
+	students map[string]*models.Client
+	teacher  *models.Client // Owner
+	// Co-teachers and observers, in join order
+	members []*models.Client
+
+	// Students whose socket dropped but who may still resume their slot
+	detached map[string]*detachedSession
+	// Last presence state pushed to staff, by clientId
+	presence map[string]presenceState
+
+	// Members of this class connected to other instances (backplane)
+	remote      map[string]*remoteStudent
+	remoteStaff map[string]int // Staff dashboards per instance ID
+
+	// Commands issued from this instance still awaiting a reply, by commandId
+	pending map[string]*pendingCommand
+
+	// Lifecycle channels
+	register   chan *models.Client
+	unregister chan *models.Client
+	broadcast  chan *models.BroadcastMessage
+	expire     chan sessionExpiry
+	remoteIn   chan *backplane.Envelope
+	drain      chan chan<- []*models.Client
+
+	commands       chan *Command
+	commandReplies chan *CommandReply
+	commandExpire  chan string
+	kicks          chan *Kick
+
+	done chan struct{} // Closed once the room is retired
+
+	mu sync.RWMutex
+}
+
+// remoteStudent is a student registered on another instance
+type remoteStudent struct {
+	origin string
+	email  string
+}
+
+// detachedSession keeps a dropped student's slot alive for the grace window
+type detachedSession struct {
+	client *models.Client // Old connection; Send is already closed
+	token  string
+	timer  *time.Timer
+}
+
+// sessionExpiry is raised by a grace timer and handled on the room loop
+type sessionExpiry struct {
+	clientID string
+	token    string
+}
+
+func newRoom(code string, hub *Hub) *Room {
+	return &Room{
+		code:     code,
+		hub:      hub,
+		students: make(map[string]*models.Client),
+		detached: make(map[string]*detachedSession),
+		presence: make(map[string]presenceState),
+
+		remote:      make(map[string]*remoteStudent),
+		remoteStaff: make(map[string]int),
+		pending:     make(map[string]*pendingCommand),
+
+		register:   make(chan *models.Client),
+		unregister: make(chan *models.Client),
+		broadcast:  make(chan *models.BroadcastMessage, 256), // Larger buffer for control messages
+		expire:     make(chan sessionExpiry, 16),
+		remoteIn:   make(chan *backplane.Envelope, 256),
+		drain:      make(chan chan<- []*models.Client),
+		done:       make(chan struct{}),
+
+		commands:       make(chan *Command, 64),
+		commandReplies: make(chan *CommandReply, 64),
+		commandExpire:  make(chan string, 16),
+		kicks:          make(chan *Kick, 16),
+	}
+}
+
+// run is the room's event loop. It exits once the room is empty.
+func (r *Room) run() {
+	presence := time.NewTicker(r.hub.config.PresenceInterval)
+	defer presence.Stop()
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case client := <-r.register:
+			r.handleRegister(client)
+
+		case client := <-r.unregister:
+			r.handleUnregister(client)
+
+		case message := <-r.broadcast:
+			r.handleBroadcast(message)
+
+		case expiry := <-r.expire:
+			r.handleExpiry(expiry)
+
+		case env := <-r.remoteIn:
+			r.handleRemote(env)
+
+		case reply := <-r.drain:
+			r.handleDrain(reply)
+
+		case cmd := <-r.commands:
+			r.handleCommand(cmd)
+
+		case reply := <-r.commandReplies:
+			r.handleCommandReply(reply)
+
+		case id := <-r.commandExpire:
+			r.handleCommandTimeout(id)
+
+		case kick := <-r.kicks:
+			r.handleKick(kick)
+
+		case <-presence.C:
+			r.evaluatePresence()
+
+		case <-resync.C:
+			r.resyncStaff()
+		}
+
+		// Only the loop mutates membership, so this check needs no lock
+		if r.isEmpty() {
+			r.hub.retireRoom(r)
+			r.drainAfterRetire()
+			return
+		}
+	}
+}
+
+// drainAfterRetire forwards backplane traffic that raced the retirement to
+// the room's successor. Queued broadcasts have no audience and are dropped.
+func (r *Room) drainAfterRetire() {
+	for {
+		select {
+		case env := <-r.remoteIn:
+			go r.hub.dispatchRemote(env)
+		default:
+			return
+		}
+	}
+}
+
+// isEmpty reports whether nobody is left in the room, so it can be dropped.
+func (r *Room) isEmpty() bool {
+	return r.teacher == nil && len(r.members) == 0 && len(r.students) == 0 && len(r.detached) == 0 &&
+		len(r.remote) == 0 && len(r.remoteStaff) == 0
+}
+
+// hasRemoteAudience reports whether a broadcast target has members on other instances
+func (r *Room) hasRemoteAudience(target string) bool {
+	switch target {
+	case models.TargetStaff:
+		return len(r.remoteStaff) > 0
+	case models.TargetStudents:
+		return len(r.remote) > 0
+	default:
+		_, ok := r.remote[target]
+		return ok
+	}
+}
+
+// staff returns every dashboard connected to the room, owner first
+func (r *Room) staff() []*models.Client {
+	staff := make([]*models.Client, 0, len(r.members)+1)
+	if r.teacher != nil {
+		staff = append(staff, r.teacher)
+	}
+	return append(staff, r.members...)
+}
+
+// removeMember drops a non-owner staff connection, reporting whether it was present
+func (r *Room) removeMember(client *models.Client) bool {
+	for i, m := range r.members {
+		if m == client {
+			r.members = append(r.members[:i], r.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hasLocalStudent reports whether a student holds a live or detached slot on this instance
+func (r *Room) hasLocalStudent(clientID string) bool {
+	_, live := r.students[clientID]
+	_, parked := r.detached[clientID]
+	return live || parked
+}
+
+func (r *Room) handleRegister(client *models.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client.GetClientType() == "teacher" {
+		r.registerTeacher(client)
+	} else if client.GetClientType() == "student" {
+		r.registerStudent(client)
+	}
+}
+
+func (r *Room) handleUnregister(client *models.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client.GetClientType() == "teacher" {
+		r.unregisterTeacher(client)
+	} else if client.GetClientType() == "student" {
+		r.unregisterStudent(client)
+	}
+}
+
+// handleBroadcast processes low-priority control messages (chat, commands)
+// Messages never leave the class they were raised in, but may reach members
+// of that class connected to other instances through the backplane.
+// No lock is taken: the loop is the only writer, so fan-out never blocks
+// fast-path readers or other classes.
+func (r *Room) handleBroadcast(message *models.BroadcastMessage) {
+	r.deliverLocal(message.Target, message.Message)
+	if r.hasRemoteAudience(message.Target) {
+		r.hub.publish(&backplane.Envelope{
+			Kind:      backplane.KindRelay,
+			ClassCode: r.code,
+			Target:    message.Target,
+			Payload:   message.Message,
+		})
+	}
+}
+
+// deliverLocal fans a message out to this instance's members of the room.
+// Runs on the room loop.
+func (r *Room) deliverLocal(target string, msg []byte) {
+	if target == models.TargetStaff {
+		for _, t := range r.staff() {
+			trySend(t, msg)
+		}
+	} else if target == models.TargetStudents {
+		for _, s := range r.students {
+			trySend(s, msg)
+		}
+	} else if client, ok := r.students[target]; ok {
+		trySend(client, msg)
+	}
+}
+
+// deliverStream fans a screenshot relayed from another instance out to local
+// staff. Like the HandleScreenshot fast path it is never numbered and is
+// dropped for lagging dashboards. Runs on the room loop.
+func (r *Room) deliverStream(msg []byte) {
+	if models.IsBinaryFrame(msg) {
+		models.SendScreenshotFrame(r.staff(), msg)
+		return
+	}
+	for _, t := range r.staff() {
+		t.TrySend(msg)
+	}
+}
+
+// Internal helper to send map as json to every staff member in the room
+func (r *Room) sendToStaff(msg interface{}) {
+	if data, err := json.Marshal(msg); err == nil {
+		for _, t := range r.staff() {
+			trySend(t, data)
+		}
+	}
+}
+
+// sendInitialStudentList pushes the class roster to a newly registered dashboard.
+// Runs on the room loop.
+func (r *Room) sendInitialStudentList(teacher *models.Client) bool {
+	list := make([]models.RosterEntry, 0, len(r.students)+len(r.detached)+len(r.remote))
+	for _, s := range r.students {
+		list = append(list, models.RosterEntry{
+			ClientID: s.GetClientID(),
+			Email:    s.Email,
+			Presence: r.presenceOf(s.GetClientID()),
+		})
+	}
+	// Detached students still own their tile until the grace window expires
+	for _, d := range r.detached {
+		list = append(list, models.RosterEntry{
+			ClientID: d.client.GetClientID(),
+			Email:    d.client.Email,
+		})
+	}
+	for id, rs := range r.remote {
+		if !r.hasLocalStudent(id) {
+			list = append(list, models.RosterEntry{
+				ClientID: id,
+				Email:    rs.email,
+			})
+		}
+	}
+
+	msg := models.Envelope{
+		Type: "initial_student_list",
+		Data: list,
+	}
+	data, err := json.Marshal(msg)
+	return err == nil && trySend(teacher, data)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"saber-websocket/utils"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Room loop throughput. Every class runs its own loop, so work spread over
+// many classes should scale with GOMAXPROCS; compare the procs=N results.
+//
+//	go test ./server -run '^$' -bench . -benchmem
+
+const (
+	benchClasses  = 64
+	benchStudents = 30
+)
+
+var benchProcs = []int{1, 2, 4, 8}
+
+func benchHub() *Hub {
+	cfg := config.LoadConfig()
+	cfg.ResumeGracePeriod = 0
+	cfg.MaxStudents = 1 << 20
+	logger := utils.NewLogger()
+	logger.SetLevel(utils.ERROR)
+	return NewHub(cfg, logger)
+}
+
+// benchClient is a connection without a socket. Unless the caller reads Send
+// itself, a goroutine drains it the way a writePump would.
+func benchClient(kind, id, classCode string, drain bool) *models.Client {
+	c := &models.Client{
+		Send:        make(chan []byte, 256),
+		ClassCode:   classCode,
+		ConnectedAt: time.Now(),
+		LastSeen:    time.Now(),
+		CurrentTabs: make(map[string]json.RawMessage),
+	}
+	if kind == "teacher" {
+		c.RequestedRole = models.RoleOwner
+	}
+	c.Identify(kind, id)
+	if drain {
+		go func() {
+			for range c.Send {
+			}
+		}()
+	}
+	return c
+}
+
+// populate opens every class with an owner and, optionally, its students
+func populate(h *Hub, students int) {
+	for i := 0; i < benchClasses; i++ {
+		class := fmt.Sprintf("C%d", i)
+		h.Register(benchClient("teacher", "t"+class, class, true))
+		for j := 0; j < students; j++ {
+			h.Register(benchClient("student", fmt.Sprintf("s%d", j), class, true))
+		}
+	}
+	// Registration is queued on the room loops; let them catch up
+	for _, room := range h.allRooms() {
+		for {
+			room.mu.RLock()
+			n := len(room.students)
+			room.mu.RUnlock()
+			if n == students {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func stopHub(b *testing.B, h *Hub) {
+	b.StopTimer()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := h.Shutdown(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// perProcs runs bench once for each GOMAXPROCS setting
+func perProcs(b *testing.B, bench func(b *testing.B)) {
+	for _, procs := range benchProcs {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			bench(b)
+		})
+	}
+}
+
+// BenchmarkBroadcast fans a control message out to every student of a class,
+// with senders spread across all the classes
+func BenchmarkBroadcast(b *testing.B) {
+	perProcs(b, func(b *testing.B) {
+		h := benchHub()
+		populate(h, benchStudents)
+		msg := []byte(`{"type":"announcement","data":{"text":"Eyes on the board"}}`)
+
+		var next uint64
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				h.Broadcast(&models.BroadcastMessage{
+					ClassCode: fmt.Sprintf("C%d", i%benchClasses),
+					Target:    models.TargetStudents,
+					Message:   msg,
+				})
+			}
+		})
+		stopHub(b, h)
+	})
+}
+
+// BenchmarkRegister joins and leaves students across many classes. Each
+// iteration waits for student_registered, so it measures the round trip
+// through the class loop rather than just queueing.
+func BenchmarkRegister(b *testing.B) {
+	perProcs(b, func(b *testing.B) {
+		h := benchHub()
+		populate(h, 0)
+
+		var next uint64
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				c := benchClient("student", fmt.Sprintf("s%d", i), fmt.Sprintf("C%d", i%benchClasses), false)
+				h.Register(c)
+				<-c.Send
+				h.Unregister(c)
+			}
+		})
+		stopHub(b, h)
+	})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"saber-websocket/models"
+)
+
+// Shutdown tells every connected client the server is going away, closes
+// their sockets with 1001 (going away) and waits for their write pumps to
+// flush, or for ctx to expire. It returns how many clients were drained.
+// New registrations are refused once Shutdown has started.
+func (h *Hub) Shutdown(ctx context.Context) (int, error) {
+	clients, err := h.closeRooms(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	flushed := 0
+	for _, client := range clients {
+		if client.WriteDone == nil {
+			flushed++
+			continue
+		}
+		select {
+		case <-client.WriteDone:
+			flushed++
+		case <-ctx.Done():
+			h.logger.Warn(fmt.Sprintf("Drain timed out: %d of %d clients flushed", flushed, len(clients)))
+			return flushed, ctx.Err()
+		}
+	}
+	return flushed, nil
+}
+
+// closeRooms refuses new rooms, drains every class and waits for its loop to
+// exit. It returns the clients that were closed.
+func (h *Hub) closeRooms(ctx context.Context) ([]*models.Client, error) {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	var clients []*models.Client
+	for _, room := range h.allRooms() {
+		reply := make(chan []*models.Client, 1)
+		select {
+		case room.drain <- reply:
+			clients = append(clients, <-reply...)
+		case <-room.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// A drained room is empty, so its loop retires it right away
+		select {
+		case <-room.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return clients, nil
+}
+
+// handleDrain notifies and closes every local member, then empties the room
+// so the loop retires it.
+func (r *Room) handleDrain(reply chan<- []*models.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := r.staff()
+	for _, s := range r.students {
+		clients = append(clients, s)
+	}
+	for _, client := range clients {
+		sendShutdownNotice(client, r.hub.config.ShutdownReconnectHint.Milliseconds())
+		client.CloseWith(models.CloseServerShutdown, "server_shutdown")
+	}
+	for _, d := range r.detached {
+		d.timer.Stop()
+	}
+
+	r.teacher = nil
+	r.members = nil
+	r.students = make(map[string]*models.Client)
+	r.detached = make(map[string]*detachedSession)
+	r.remote = make(map[string]*remoteStudent)
+	r.remoteStaff = make(map[string]int)
+
+	reply <- clients
+}
+
+// sendShutdownNotice tells a client to reconnect after a jittered delay, so
+// a whole school does not hit the replacement instance in the same instant.
+func sendShutdownNotice(client *models.Client, hintMs int64) {
+	if hintMs > 0 {
+		hintMs += rand.Int63n(hintMs)
+	}
+	data, err := json.Marshal(models.Envelope{
+		Type: "server_shutdown",
+		Data: models.ServerShutdown{Reason: "server_shutdown", ReconnectAfterMs: hintMs},
+	})
+	if err == nil {
+		client.TrySend(data)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/audit"
+	"saber-websocket/config"
+	"saber-websocket/models"
+)
+
+// Staff (teacher dashboard) membership. All methods run on the room loop
+// with r.mu held for writing.
+
+func (r *Room) registerTeacher(client *models.Client) {
+	role, reason := client.RequestedRole, ""
+	if role == models.RoleOwner && r.teacher != nil {
+		role, reason = r.resolveTakeover(client)
+		if role == "" {
+			return
+		}
+	}
+
+	client.SetRole(role)
+	if role == models.RoleOwner {
+		r.teacher = client
+	} else {
+		r.members = append(r.members, client)
+	}
+	client.MarkRegistered()
+	r.hub.logger.Info(fmt.Sprintf("Teacher %s connected to %s as %s", client.GetClientID(), r.code, role))
+	r.auditTeacher(audit.EventTeacherConnected, client, reason, nil)
+	r.sendTeacherRegistered(client, reason)
+	r.notifyStaffChange(client, "staff_joined")
+	r.publishStaffCount()
+
+	// Push initial state immediately
+	r.sendInitialStudentList(client)
+}
+
+func (r *Room) unregisterTeacher(client *models.Client) {
+	if r.teacher == client {
+		r.teacher = nil
+	} else if !r.removeMember(client) {
+		return
+	}
+	client.Close()
+	r.hub.logger.Info(fmt.Sprintf("Teacher %s (%s) disconnected from %s", client.GetClientID(), client.GetRole(), r.code))
+	r.auditTeacher(audit.EventTeacherDisconnected, client, "", nil)
+	r.notifyStaffChange(client, "staff_left")
+	r.publishStaffCount()
+	if r.teacher == nil {
+		r.promoteDemotedOwner()
+	}
+}
+
+// resolveTakeover applies the configured policy when a teacher connects to a
+// class that already has an owner. It returns the newcomer's role and the
+// reason reported to them, or an empty role if the newcomer was refused.
+func (r *Room) resolveTakeover(client *models.Client) (string, string) {
+	switch r.hub.config.TeacherTakeoverPolicy {
+	case config.TakeoverReject:
+		r.hub.logger.Warn(fmt.Sprintf("Teacher %s refused for %s, class already has a teacher", client.GetClientID(), r.code))
+		sendErrorCode(client, "teacher_already_connected", "Another teacher is already connected to this class")
+		client.CloseWith(models.CloseRejected, "teacher_already_connected")
+		r.auditTakeover(client, config.TakeoverReject)
+		return "", ""
+
+	case config.TakeoverObserve:
+		r.auditTakeover(client, config.TakeoverObserve)
+		return models.RoleObserver, "class_has_owner"
+
+	default:
+		old := r.teacher
+		r.hub.logger.Warn(fmt.Sprintf("New teacher connecting to %s, closing old session", r.code))
+		if data, err := json.Marshal(models.Envelope{
+			Type: "session_displaced",
+			Data: models.SessionDisplaced{Reason: "teacher_takeover", TeacherID: client.GetClientID()},
+		}); err == nil {
+			old.TrySend(data)
+		}
+		old.CloseWith(models.CloseTeacherTakeover, "teacher_takeover")
+		r.auditTakeover(client, config.TakeoverReplace)
+		r.teacher = nil
+		return models.RoleOwner, "teacher_takeover"
+	}
+}
+
+// promoteDemotedOwner hands an ownerless class to the longest-connected
+// teacher who was demoted to observer by the takeover policy. Staff whose
+// token only grants co_teacher or observer are never promoted.
+func (r *Room) promoteDemotedOwner() {
+	for _, next := range r.members {
+		if next.RequestedRole != models.RoleOwner {
+			continue
+		}
+		r.removeMember(next)
+		r.teacher = next
+		next.SetRole(models.RoleOwner)
+		r.hub.logger.Info(fmt.Sprintf("Teacher %s promoted to owner of %s", next.GetClientID(), r.code))
+		r.auditTeacher(audit.EventTeacherPromoted, next, "owner_left", nil)
+		r.sendTeacherRegistered(next, "owner_left")
+		r.notifyStaffChange(next, "staff_role_changed")
+		return
+	}
+}
+
+// sendTeacherRegistered tells a dashboard which role it ended up with and who
+// else is on staff.
+func (r *Room) sendTeacherRegistered(client *models.Client, reason string) {
+	staff := make([]models.StaffMember, 0)
+	for _, s := range r.staff() {
+		staff = append(staff, staffEntry(s))
+	}
+	data, err := json.Marshal(models.Envelope{
+		Type: "teacher_registered",
+		Data: models.TeacherRegistered{
+			ClassCode: client.ClassCode,
+			Role:      client.GetRole(),
+			Reason:    reason,
+			Staff:     staff,
+		},
+	})
+	if err == nil {
+		trySend(client, data)
+	}
+}
+
+// notifyStaffChange tells the other staff members that someone joined, left or changed role.
+func (r *Room) notifyStaffChange(client *models.Client, eventType string) {
+	data, err := json.Marshal(models.Envelope{
+		Type: eventType,
+		Data: staffEntry(client),
+	})
+	if err != nil {
+		return
+	}
+	for _, s := range r.staff() {
+		if s != client {
+			trySend(s, data)
+		}
+	}
+}
+
+func staffEntry(client *models.Client) models.StaffMember {
+	return models.StaffMember{
+		TeacherID: client.GetClientID(),
+		Email:     client.Email,
+		Role:      client.GetRole(),
+	}
+}
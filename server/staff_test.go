@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"testing"
+)
+
+// staffHub is a hub applying a teacher takeover policy
+func staffHub(policy string) *Hub {
+	h := benchHub()
+	h.config.TeacherTakeoverPolicy = policy
+	return h
+}
+
+// dashboard is a teacher connection whose token grants role
+func dashboard(id, role string) *models.Client {
+	c := benchClient("teacher", id, "C1", false)
+	c.RequestedRole = role
+	return c
+}
+
+// registered reads c's teacher_registered
+func registered(t *testing.T, c *models.Client) models.TeacherRegistered {
+	t.Helper()
+	var reg models.TeacherRegistered
+	if err := json.Unmarshal(expect(t, c, "teacher_registered").Data, &reg); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// staffEvent reads c's next staff notification of type typ
+func staffEvent(t *testing.T, c *models.Client, typ string) models.StaffMember {
+	t.Helper()
+	var m models.StaffMember
+	if err := json.Unmarshal(expect(t, c, typ).Data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func owner(h *Hub) *models.Client {
+	room := h.room("C1", false)
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.teacher
+}
+
+// A second owner-level teacher meets the class's owner under each policy. A
+// co-teacher looks on to check what the rest of the staff are told.
+func TestTakeover(t *testing.T) {
+	cases := []struct {
+		policy string
+		role   string // The newcomer's role, "" if refused
+		reason string // In the newcomer's teacher_registered
+	}{
+		{config.TakeoverReplace, models.RoleOwner, "teacher_takeover"},
+		{config.TakeoverReject, "", ""},
+		{config.TakeoverObserve, models.RoleObserver, "class_has_owner"},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			h := staffHub(c.policy)
+			defer shutdown(t, h)
+			first := dashboard("t1", models.RoleOwner)
+			h.Register(first)
+			registered(t, first)
+			witness := dashboard("c1", models.RoleCoTeacher)
+			h.Register(witness)
+			registered(t, witness)
+
+			newcomer := dashboard("t2", models.RoleOwner)
+			h.Register(newcomer)
+
+			if c.role == "" {
+				if m := expect(t, newcomer, "error"); m.Code != "teacher_already_connected" {
+					t.Errorf("refused with %s, want teacher_already_connected", m.Code)
+				}
+				if code := closeCode(t, newcomer); code != models.CloseRejected {
+					t.Errorf("refused dashboard closed with %d, want %d", code, models.CloseRejected)
+				}
+				if code, _ := first.CloseInfo(); code != 0 || owner(h) != first {
+					t.Errorf("owner closed with %d, want it left alone", code)
+				}
+				return
+			}
+
+			reg := registered(t, newcomer)
+			if reg.Role != c.role || reg.Reason != c.reason {
+				t.Errorf("teacher_registered %s (%s), want %s (%s)", reg.Role, reg.Reason, c.role, c.reason)
+			}
+			if joined := staffEvent(t, witness, "staff_joined"); joined.TeacherID != "t2" || joined.Role != c.role {
+				t.Errorf("staff_joined %+v, want t2 as %s", joined, c.role)
+			}
+
+			if c.role == models.RoleObserver {
+				staffEvent(t, first, "staff_joined")
+				if code, _ := first.CloseInfo(); code != 0 || owner(h) != first {
+					t.Errorf("owner closed with %d, want it left alone", code)
+				}
+				return
+			}
+
+			var displaced models.SessionDisplaced
+			json.Unmarshal(expect(t, first, "session_displaced").Data, &displaced)
+			if displaced.Reason != "teacher_takeover" || displaced.TeacherID != "t2" {
+				t.Errorf("session_displaced %+v", displaced)
+			}
+			if code := closeCode(t, first); code != models.CloseTeacherTakeover {
+				t.Errorf("displaced owner closed with %d, want %d", code, models.CloseTeacherTakeover)
+			}
+			// Its socket going away afterwards mustn't disturb the new owner
+			h.Unregister(first)
+			h.Register(dashboard("c2", models.RoleCoTeacher)) // Handled after the Unregister
+			staffEvent(t, witness, "staff_joined")
+			if owner(h) != newcomer {
+				t.Error("new owner lost when the displaced dashboard disconnected")
+			}
+		})
+	}
+}
+
+// Owners demoted to observer by the observe policy take over again, longest
+// connected first, when the owner leaves. Co-teachers never become owner.
+func TestDemotedOwnerPromoted(t *testing.T) {
+	h := staffHub(config.TakeoverObserve)
+	defer shutdown(t, h)
+	first := dashboard("t1", models.RoleOwner)
+	h.Register(first)
+	registered(t, first)
+	witness := dashboard("c1", models.RoleCoTeacher)
+	h.Register(witness)
+	registered(t, witness)
+	second := dashboard("t2", models.RoleOwner)
+	h.Register(second)
+	registered(t, second)
+	third := dashboard("t3", models.RoleOwner)
+	h.Register(third)
+	registered(t, third)
+
+	for _, next := range []*models.Client{second, third} {
+		h.Unregister(owner(h))
+		reg := registered(t, next)
+		if reg.Role != models.RoleOwner || reg.Reason != "owner_left" {
+			t.Errorf("%s: teacher_registered %s (%s), want owner (owner_left)", next.GetClientID(), reg.Role, reg.Reason)
+		}
+		if changed := staffEvent(t, witness, "staff_role_changed"); changed.TeacherID != next.GetClientID() || changed.Role != models.RoleOwner {
+			t.Errorf("staff_role_changed %+v, want %s as owner", changed, next.GetClientID())
+		}
+		if owner(h) != next {
+			t.Errorf("owner is %v, want %s", owner(h), next.GetClientID())
+		}
+	}
+
+	// Only the co-teacher is left: the class stays ownerless
+	h.Unregister(third)
+	staffEvent(t, witness, "staff_left")
+	if o := owner(h); o != nil {
+		t.Errorf("%s became owner, want no owner", o.GetClientID())
+	}
+	if witness.GetRole() != models.RoleCoTeacher {
+		t.Errorf("co-teacher's role changed to %s", witness.GetRole())
+	}
+	quietStaff(t, witness)
+}
+
+// quietStaff fails if c has a staff_role_changed queued
+func quietStaff(t *testing.T, c *models.Client) {
+	t.Helper()
+	for {
+		select {
+		case raw := <-c.Send:
+			var m message
+			json.Unmarshal(raw, &m)
+			if m.Type == "staff_role_changed" {
+				t.Errorf("%s: unexpected %s", c.GetClientID(), raw)
+			}
+		default:
+			return
+		}
+	}
+}
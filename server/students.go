@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"saber-websocket/backplane"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"strings"
+	"time"
+)
+
+// Student membership: registration, resume, duplicates and the grace window.
+// Unless noted otherwise, methods run on the room loop with r.mu held for writing.
+
+func (r *Room) registerStudent(client *models.Client) {
+	resumed := r.resumeSession(client)
+
+	if !resumed && len(r.students)+len(r.detached) >= r.hub.config.MaxStudents {
+		sendError(client, "Class is full")
+		client.CloseWith(models.CloseClassFull, "class_full")
+		return
+	}
+
+	if !resumed {
+		// A slot held for resume counts as taken: without the token this is
+		// just another connection claiming the same clientId
+		existing, ok := r.students[client.GetClientID()]
+		if session, held := r.detached[client.GetClientID()]; held {
+			existing, ok = session.client, true
+		}
+		if ok && !r.resolveDuplicate(existing, client) {
+			return
+		}
+	}
+
+	r.students[client.GetClientID()] = client
+	client.MarkRegistered()
+	r.issueResumeToken(client, resumed)
+
+	if resumed {
+		// Teacher never saw the drop, so there is nothing to tell them
+		r.hub.logger.Info(fmt.Sprintf("Student ~ : %s (%s) [%s] resumed", client.Email, client.GetClientID(), r.code))
+		return
+	}
+	r.hub.logger.Info(fmt.Sprintf("Student + : %s (%s) [%s]", client.Email, client.GetClientID(), r.code))
+	r.publishStudentJoined(client)
+
+	// Notify Teacher (Control Message)
+	r.sendToStaff(models.Envelope{
+		Type: "student_connected",
+		Data: models.StudentConnected{ClientID: client.GetClientID(), Email: client.Email},
+	})
+}
+
+func (r *Room) unregisterStudent(client *models.Client) {
+	// Only the connection currently holding the slot may release it
+	if current, ok := r.students[client.GetClientID()]; ok && current == client {
+		delete(r.students, client.GetClientID())
+		client.Close()
+
+		if r.hub.config.ResumeGracePeriod > 0 {
+			r.detachStudent(client)
+			return
+		}
+		r.hub.logger.Info(fmt.Sprintf("Student - : %s [%s]", client.GetClientID(), r.code))
+		r.releaseStudent(client.GetClientID())
+	}
+}
+
+// resumeSession hands a student's previous slot to the new connection when it
+// presents the resume token it was issued. The old connection may be detached
+// (socket already dropped) or still live (drop not yet noticed by the pong timeout).
+func (r *Room) resumeSession(client *models.Client) bool {
+	slotID, previous := r.findResumableSlot(client)
+	if previous == nil {
+		return false
+	}
+
+	if session, ok := r.detached[slotID]; ok {
+		session.timer.Stop()
+		delete(r.detached, slotID)
+	} else {
+		delete(r.students, slotID)
+		previous.CloseWith(models.CloseSessionReplaced, "session_resumed")
+	}
+
+	// In multi-device mode the slot may live under a per-connection sub-ID
+	client.SetClientID(slotID)
+	client.SetCurrentTabs(previous.GetCurrentTabs())
+	return true
+}
+
+// findResumableSlot locates the slot whose resume token the client presented,
+// searching both detached and live sessions for the client's ID and its sub-IDs.
+func (r *Room) findResumableSlot(client *models.Client) (string, *models.Client) {
+	if client.ResumeToken == "" {
+		return "", nil
+	}
+	for id, session := range r.detached {
+		if baseClientID(id) == client.GetClientID() && tokensMatch(client.ResumeToken, session.token) {
+			return id, session.client
+		}
+	}
+	for id, live := range r.students {
+		if baseClientID(id) == client.GetClientID() && tokensMatch(client.ResumeToken, live.ResumeToken) {
+			return id, live
+		}
+	}
+	return "", nil
+}
+
+// resolveDuplicate applies the configured policy when a new connection claims
+// a clientId that is already live, or held for resume, without a valid resume
+// token. It returns false if the new connection was refused.
+func (r *Room) resolveDuplicate(existing, client *models.Client) bool {
+	policy := r.hub.config.DuplicateClientPolicy
+	baseID := client.GetClientID()
+
+	switch policy {
+	case config.DuplicateReject:
+		r.hub.logger.Warn(fmt.Sprintf("Duplicate clientId %s [%s] rejected", baseID, r.code))
+		sendErrorCode(client, "duplicate_client", "This clientId is already connected")
+		client.CloseWith(models.CloseRejected, "duplicate_client_id")
+		r.notifyDuplicate(policy, "rejected", baseID, baseID)
+		return false
+
+	case config.DuplicateMulti:
+		client.SetClientID(r.nextDeviceID(baseID))
+		r.hub.logger.Info(fmt.Sprintf("Duplicate clientId %s [%s] added as %s", baseID, r.code, client.GetClientID()))
+		r.notifyDuplicate(policy, "added_device", baseID, client.GetClientID())
+		return true
+
+	default:
+		r.hub.logger.Warn(fmt.Sprintf("Duplicate clientId %s [%s], replacing old connection", baseID, r.code))
+		if session, ok := r.detached[baseID]; ok {
+			// Its socket is already gone; just give up the held slot
+			session.timer.Stop()
+			delete(r.detached, baseID)
+			r.notifyDuplicate(policy, "replaced", baseID, baseID)
+			return true
+		}
+		if data, err := json.Marshal(models.Envelope{
+			Type: "session_replaced",
+			Data: models.SessionReplaced{ClientID: baseID, Reason: "duplicate_client_id"},
+		}); err == nil {
+			existing.TrySend(data)
+		}
+		delete(r.students, baseID)
+		existing.CloseWith(models.CloseSessionReplaced, "duplicate_client_id")
+		r.notifyDuplicate(policy, "replaced", baseID, baseID)
+		return true
+	}
+}
+
+func (r *Room) notifyDuplicate(policy, action, baseID, clientID string) {
+	r.sendToStaff(models.Envelope{
+		Type: "student_duplicate",
+		Data: models.StudentDuplicate{
+			ClientID:     clientID,
+			BaseClientID: baseID,
+			Policy:       policy,
+			Action:       action,
+		},
+	})
+}
+
+// nextDeviceID returns the first free "<clientId>#<n>" sub-ID in the room.
+func (r *Room) nextDeviceID(baseID string) string {
+	for n := 2; ; n++ {
+		id := fmt.Sprintf("%s#%d", baseID, n)
+		if !r.hasLocalStudent(id) {
+			return id
+		}
+	}
+}
+
+// baseClientID strips a multi-device sub-ID suffix
+func baseClientID(id string) string {
+	if i := strings.LastIndexByte(id, '#'); i > 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// issueResumeToken rotates the client's resume token and tells the extension about it.
+func (r *Room) issueResumeToken(client *models.Client, resumed bool) {
+	client.ResumeToken = newToken()
+	data, err := json.Marshal(models.Envelope{
+		Type: "student_registered",
+		Data: models.StudentRegistered{
+			ClientID:       client.GetClientID(),
+			ClassCode:      client.ClassCode,
+			ResumeToken:    client.ResumeToken,
+			ResumeWindowMs: r.hub.config.ResumeGracePeriod.Milliseconds(),
+			Resumed:        resumed,
+		},
+	})
+	if err == nil {
+		trySend(client, data)
+	}
+}
+
+// detachStudent parks a dropped student's slot until the grace window expires.
+func (r *Room) detachStudent(client *models.Client) {
+	expiry := sessionExpiry{clientID: client.GetClientID(), token: client.ResumeToken}
+	r.detached[client.GetClientID()] = &detachedSession{
+		client: client,
+		token:  client.ResumeToken,
+		timer: time.AfterFunc(r.hub.config.ResumeGracePeriod, func() {
+			select {
+			case r.expire <- expiry:
+			case <-r.done:
+			}
+		}),
+	}
+	r.hub.logger.Info(fmt.Sprintf("Student ? : %s [%s] detached, holding slot for %s",
+		client.GetClientID(), r.code, r.hub.config.ResumeGracePeriod))
+}
+
+// handleExpiry releases a detached slot whose grace window ran out
+func (r *Room) handleExpiry(expiry sessionExpiry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.detached[expiry.clientID]
+	// A resume (or a newer detach) may have won the race against the timer
+	if !ok || session.token != expiry.token {
+		return
+	}
+
+	delete(r.detached, expiry.clientID)
+	r.hub.logger.Info(fmt.Sprintf("Student - : %s [%s]", expiry.clientID, r.code))
+	r.releaseStudent(expiry.clientID)
+}
+
+// Kick is a teacher_kick on its way to the class loop
+type Kick struct {
+	Issuer *models.Client
+	Target string // Student clientId
+	Reason string // Passed on to the student
+}
+
+// Kick hands a teacher_kick to the issuer's class loop
+func (h *Hub) Kick(k *Kick) {
+	if room := h.room(k.Issuer.ClassCode, false); room != nil {
+		select {
+		case room.kicks <- k:
+		case <-room.done:
+		}
+	}
+}
+
+// handleKick removes a student at a teacher's request. A held slot is
+// released as well, so the student can't resume it; a student connected to
+// another instance is kicked there.
+func (r *Room) handleKick(k *Kick) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	outcome := "kicked"
+	if !r.kickLocal(k.Target, k.Reason) {
+		if _, ok := r.remote[k.Target]; ok {
+			r.hub.publish(&backplane.Envelope{
+				Kind:      backplane.KindKick,
+				ClassCode: r.code,
+				ClientID:  k.Target,
+				Payload:   []byte(k.Reason),
+			})
+			outcome = "forwarded"
+		} else {
+			outcome = "not_found"
+			sendErrorCode(k.Issuer, "not_found", "Student not found")
+		}
+	}
+	r.auditKick(k, outcome)
+}
+
+// kickLocal closes a local student's connection (or drops its held slot) and
+// announces that it left. It reports whether the student was here.
+func (r *Room) kickLocal(clientID, reason string) bool {
+	if student, ok := r.students[clientID]; ok {
+		if data, err := json.Marshal(models.Envelope{
+			Type: "kicked",
+			Data: models.Kicked{ClientID: clientID, Reason: reason},
+		}); err == nil {
+			student.TrySend(data)
+		}
+		delete(r.students, clientID)
+		student.CloseWith(models.CloseKicked, "kicked")
+	} else if session, ok := r.detached[clientID]; ok {
+		session.timer.Stop()
+		delete(r.detached, clientID)
+	} else {
+		return false
+	}
+	r.hub.logger.Info(fmt.Sprintf("Student - : %s [%s] kicked", clientID, r.code))
+	r.releaseStudent(clientID)
+	return true
+}
+
+// releaseStudent announces that a local student's slot is gone for good.
+func (r *Room) releaseStudent(clientID string) {
+	delete(r.presence, clientID)
+	r.hub.publish(&backplane.Envelope{Kind: backplane.KindStudentLeft, ClassCode: r.code, ClientID: clientID})
+	// The student may already have reconnected through another instance
+	if _, elsewhere := r.remote[clientID]; !elsewhere {
+		r.notifyStudentDisconnected(clientID)
+	}
+}
+
+func (r *Room) notifyStudentDisconnected(clientID string) {
+	r.sendToStaff(models.Envelope{
+		Type: "student_disconnected",
+		Data: models.StudentDisconnected{ClientID: clientID},
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"saber-websocket/config"
+	"saber-websocket/models"
+	"testing"
+	"time"
+)
+
+// studentHub is a hub that holds dropped students' slots for resume
+func studentHub(policy string) *Hub {
+	h := benchHub()
+	h.config.ResumeGracePeriod = time.Minute
+	h.config.DuplicateClientPolicy = policy
+	return h
+}
+
+// join registers a student and returns its student_registered
+func join(t *testing.T, h *Hub, id, token string) (*models.Client, models.StudentRegistered) {
+	t.Helper()
+	c := benchClient("student", id, "C1", false)
+	c.ResumeToken = token
+	h.Register(c)
+	var reg models.StudentRegistered
+	if err := json.Unmarshal(expect(t, c, "student_registered").Data, &reg); err != nil {
+		t.Fatal(err)
+	}
+	return c, reg
+}
+
+// drop disconnects a student and waits for its slot to be held
+func drop(t *testing.T, h *Hub, c *models.Client) {
+	t.Helper()
+	id := c.GetClientID()
+	h.Unregister(c)
+	room := h.room("C1", false)
+	waitFor(t, id+" detached", func() bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		_, held := room.detached[id]
+		return held
+	})
+}
+
+func held(h *Hub, id string) bool {
+	room := h.room("C1", false)
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	_, ok := room.detached[id]
+	return ok
+}
+
+func live(h *Hub, id string) bool {
+	room := h.room("C1", false)
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	_, ok := room.students[id]
+	return ok
+}
+
+// resolveDuplicate under each policy, for a second connection claiming a
+// clientId that is live or whose slot is held for resume. A connection
+// without the resume token doesn't get to throw away a held slot: it's a
+// duplicate like any other.
+func TestResolveDuplicate(t *testing.T) {
+	cases := []struct {
+		policy   string
+		detached bool   // The first connection dropped and its slot is held
+		action   string // In student_duplicate
+		id       string // The newcomer's clientId, "" if refused
+		kept     bool   // Whether the first connection keeps its slot
+	}{
+		{config.DuplicateReplace, false, "replaced", "s1", false},
+		{config.DuplicateReject, false, "rejected", "", true},
+		{config.DuplicateMulti, false, "added_device", "s1#2", true},
+		{config.DuplicateReplace, true, "replaced", "s1", false},
+		{config.DuplicateReject, true, "rejected", "", true},
+		{config.DuplicateMulti, true, "added_device", "s1#2", true},
+	}
+	for _, c := range cases {
+		name := c.policy + "/live"
+		if c.detached {
+			name = c.policy + "/detached"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := studentHub(c.policy)
+			defer shutdown(t, h)
+			teacher := benchClient("teacher", "t1", "C1", false)
+			h.Register(teacher)
+			expect(t, teacher, "teacher_registered")
+
+			first, reg := join(t, h, "s1", "")
+			if c.detached {
+				drop(t, h, first)
+			}
+
+			newcomer := benchClient("student", "s1", "C1", false)
+			h.Register(newcomer)
+			var dup models.StudentDuplicate
+			json.Unmarshal(expect(t, teacher, "student_duplicate").Data, &dup)
+			wantID := c.id
+			if wantID == "" {
+				wantID = "s1"
+			}
+			if dup.Action != c.action || dup.Policy != c.policy || dup.BaseClientID != "s1" || dup.ClientID != wantID {
+				t.Errorf("student_duplicate %+v, want %s for %s", dup, c.action, wantID)
+			}
+
+			if c.id == "" {
+				if m := expect(t, newcomer, "error"); m.Code != "duplicate_client" {
+					t.Errorf("refused with %s, want duplicate_client", m.Code)
+				}
+				if code := closeCode(t, newcomer); code != models.CloseRejected {
+					t.Errorf("refused connection closed with %d, want %d", code, models.CloseRejected)
+				}
+			} else {
+				var got models.StudentRegistered
+				json.Unmarshal(expect(t, newcomer, "student_registered").Data, &got)
+				if got.ClientID != c.id || got.Resumed {
+					t.Errorf("newcomer registered as %s (resumed %v), want %s", got.ClientID, got.Resumed, c.id)
+				}
+				if !live(h, c.id) {
+					t.Errorf("newcomer not live as %s", c.id)
+				}
+			}
+
+			if c.detached {
+				if held(h, "s1") != c.kept {
+					t.Fatalf("held slot kept = %v, want %v", !c.kept, c.kept)
+				}
+				if c.kept {
+					// The student it belongs to can still come back to it
+					_, resumed := join(t, h, "s1", reg.ResumeToken)
+					if !resumed.Resumed || resumed.ClientID != "s1" {
+						t.Errorf("resume after the duplicate: %+v", resumed)
+					}
+				}
+			} else if c.kept {
+				if code, _ := first.CloseInfo(); code != 0 || !live(h, "s1") {
+					t.Errorf("first connection closed with %d, want it left alone", code)
+				}
+			} else {
+				var sr models.SessionReplaced
+				json.Unmarshal(expect(t, first, "session_replaced").Data, &sr)
+				if sr.ClientID != "s1" || sr.Reason != "duplicate_client_id" {
+					t.Errorf("session_replaced %+v", sr)
+				}
+				if code := closeCode(t, first); code != models.CloseSessionReplaced {
+					t.Errorf("replaced connection closed with %d, want %d", code, models.CloseSessionReplaced)
+				}
+			}
+
+			if c.policy != config.DuplicateMulti {
+				return
+			}
+			// Each further device takes the next free number
+			third := benchClient("student", "s1", "C1", false)
+			h.Register(third)
+			var got models.StudentRegistered
+			json.Unmarshal(expect(t, third, "student_registered").Data, &got)
+			if got.ClientID != "s1#3" {
+				t.Errorf("third device registered as %s, want s1#3", got.ClientID)
+			}
+		})
+	}
+}